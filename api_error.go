@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Common JSON error envelope returned by every endpoint
+// ---------------------------------------------------------------------------------------------------------------//
+//
+// Mapping of internal errors to HTTP status / error code:
+//
+//   Request body not readable / invalid JSON      400  invalid_request
+//   Invalid path or query parameter (id, date,..) 400  invalid_request
+//   Missing mandatory field                       400  invalid_request
+//   Image not valid base64 / not PNG or JPEG      400  image_rejected
+//   Image too large                               413  image_rejected
+//   Authorization header missing or wrong         401  unauthorized
+//   Authorization not configured on server        500  server_config
+//   Curator not allowed for artifact kind/sport   403  forbidden
+//   Datastore - entity not found                  404  not_found
+//   Blob store - object not found                 404  not_found
+//   Datastore - invalid key / entity type         400  invalid_request
+//   Datastore - concurrent transaction            409  conflict
+//   Identical content already exists (POST)       409  duplicate
+//   CloudDB status does not allow the request     422  status_unprocessable
+//   Partial failure affects the request           503  partial_outage (+ Retry-After)
+//   App Engine - over quota                       503  over_quota
+//   App Engine - API call timed out               503  timeout
+//   Any other error                               500  internal
+
+type ErrorAPIv1 struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   string `json:"details,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// Error codes of the envelope
+const (
+	errorCode_InvalidRequest      = "invalid_request"
+	errorCode_ImageRejected       = "image_rejected"
+	errorCode_Unauthorized        = "unauthorized"
+	errorCode_Forbidden           = "forbidden"
+	errorCode_ServerConfig        = "server_config"
+	errorCode_NotFound            = "not_found"
+	errorCode_Conflict            = "conflict"
+	errorCode_Duplicate           = "duplicate"
+	errorCode_StatusUnprocessable = "status_unprocessable"
+	errorCode_PartialOutage       = "partial_outage"
+	errorCode_OverQuota           = "over_quota"
+	errorCode_Timeout             = "timeout"
+	errorCode_Internal            = "internal"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// requestIdFilter makes the request id available on the response, so that
+// error responses (and log entries) can be correlated
+func requestIdFilter(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	requestId := req.HeaderParameter(requestIdHeader)
+	if requestId == "" {
+		requestId = appengine.RequestID(appengine.NewContext(req.Request))
+	}
+	if requestId != "" {
+		resp.AddHeader(requestIdHeader, requestId)
+	}
+
+	chain.ProcessFilter(req, resp)
+}
+
+// addErrorResponse writes the JSON error envelope with the given status and code
+func addErrorResponse(r *restful.Response, httpStatus int, code string, message string, details string) {
+	apiError := ErrorAPIv1{
+		Status:    httpStatus,
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestId: r.Header().Get(requestIdHeader),
+	}
+	r.WriteHeaderAndJson(httpStatus, apiError, restful.MIME_JSON)
+}
+
+// addInvalidRequestError is the shortcut for all request validation errors (400)
+func addInvalidRequestError(r *restful.Response, message string, err error) {
+	details := ""
+	if err != nil {
+		details = err.Error()
+	}
+	addErrorResponse(r, http.StatusBadRequest, errorCode_InvalidRequest, message, details)
+}
+
+// commonResponseErrorProcessing maps any error returned by the App Engine APIs
+// or the request parsing to the error envelope - see mapping table above
+func commonResponseErrorProcessing(response *restful.Response, err error) {
+	switch e := err.(type) {
+	case *strconv.NumError:
+		addInvalidRequestError(response, "Invalid numeric parameter", e)
+		return
+	case *time.ParseError:
+		addInvalidRequestError(response, "Invalid date parameter - correct format is RFC3339", e)
+		return
+	case *imageRejectedError:
+		details := ""
+		if e.err != nil {
+			details = e.err.Error()
+		}
+		addErrorResponse(response, e.httpStatus, errorCode_ImageRejected, e.reason, details)
+		return
+	}
+
+	switch {
+	case appengine.IsOverQuota(err):
+		// return 503 and a text similar to what GAE is returning as well
+		addErrorResponse(response, http.StatusServiceUnavailable, errorCode_OverQuota, "503 - Over Quota", err.Error())
+	case appengine.IsTimeoutError(err):
+		addErrorResponse(response, http.StatusServiceUnavailable, errorCode_Timeout, "503 - Timeout", err.Error())
+	case err == datastore.ErrNoSuchEntity:
+		addErrorResponse(response, http.StatusNotFound, errorCode_NotFound, "Entity not found", err.Error())
+	case err == errBlobNotFound:
+		addErrorResponse(response, http.StatusNotFound, errorCode_NotFound, "Blob not found", err.Error())
+	case err == datastore.ErrInvalidKey, err == datastore.ErrInvalidEntityType:
+		addInvalidRequestError(response, "Invalid key or entity", err)
+	case err == datastore.ErrConcurrentTransaction:
+		addErrorResponse(response, http.StatusConflict, errorCode_Conflict, "Concurrent update - please retry", err.Error())
+	default:
+		addErrorResponse(response, http.StatusInternalServerError, errorCode_Internal, "Internal error", err.Error())
+	}
+}
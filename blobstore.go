@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Blob storage for binary content (e.g. chart images) which is kept outside of the datastore entities
+// ---------------------------------------------------------------------------------------------------------------//
+
+// BlobStore stores binary objects by name
+type BlobStore interface {
+	Put(ctx context.Context, name string, contentType string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// configuration (see app.yaml)
+const blobStoreConfig = "Blob_Store"              // "gcs" (default) or "local"
+const blobStoreBucketConfig = "Blob_Store_Bucket" // GCS bucket - default bucket of the app if not set
+const blobStoreDirConfig = "Blob_Store_Dir"       // directory for "local"
+
+const (
+	blobStore_GCS   = "gcs"
+	blobStore_Local = "local"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+var blobStore BlobStore
+var blobStoreOnce sync.Once
+
+// getBlobStore returns the configured blob store
+func getBlobStore() BlobStore {
+	blobStoreOnce.Do(func() {
+		switch os.Getenv(blobStoreConfig) {
+		case blobStore_Local:
+			dir := os.Getenv(blobStoreDirConfig)
+			if dir == "" {
+				dir = "blobs"
+			}
+			blobStore = &localBlobStore{dir: dir}
+		default:
+			blobStore = &gcsBlobStore{bucket: os.Getenv(blobStoreBucketConfig)}
+		}
+	})
+	return blobStore
+}
+
+// ------------------- Google Cloud Storage (App Engine) ------------------------------------
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+type gcsBlobStore struct {
+	bucket string
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name string, contentType string, data []byte) error {
+	bucket, err := s.bucketName(ctx)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(bucket), url.QueryEscape(name))
+	_, err = s.call(ctx, http.MethodPost, u, contentType, data)
+	return err
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	bucket, err := s.bucketName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+		url.PathEscape(bucket), url.PathEscape(name))
+	return s.call(ctx, http.MethodGet, u, "", nil)
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	bucket, err := s.bucketName(ctx)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s",
+		url.PathEscape(bucket), url.PathEscape(name))
+	_, err = s.call(ctx, http.MethodDelete, u, "", nil)
+	return err
+}
+
+func (s *gcsBlobStore) bucketName(ctx context.Context) (string, error) {
+	if s.bucket != "" {
+		return s.bucket, nil
+	}
+	return file.DefaultBucketName(ctx)
+}
+
+// call executes a request against the GCS JSON API with the app's service account
+func (s *gcsBlobStore) call(ctx context.Context, method string, u string, contentType string, data []byte) ([]byte, error) {
+	token, _, err := appengine.AccessToken(ctx, gcsScope)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprint("Bearer ", token))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errBlobNotFound
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("GCS %s %s failed with status %d: %s", method, u, resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// ------------------- Local file system (self-hosting) ------------------------------------
+
+type localBlobStore struct {
+	dir string
+}
+
+func (s *localBlobStore) Put(ctx context.Context, name string, contentType string, data []byte) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return errBlobNotFound
+	}
+	return err
+}
+
+func (s *localBlobStore) path(name string) string {
+	// names are generated internally - Clean just makes sure we stay in the directory
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+name)))
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Compression at rest of large text attributes (ChartDef, MetricXML)
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Encoding marker stored with the entity - entities stored before compression
+// was introduced have no marker (= textEncoding_Plain) and remain readable
+const (
+	textEncoding_Plain = 0
+	textEncoding_Gzip  = 1
+)
+
+// compressText returns the gzip compressed text
+func compressText(text string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeText returns the text for the given encoding, plain is used as is
+func decodeText(encoding int, plain string, compressed []byte) (string, error) {
+	switch encoding {
+	case textEncoding_Plain:
+		return plain, nil
+	case textEncoding_Gzip:
+		if len(compressed) == 0 {
+			return "", nil
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("unknown text encoding %d", encoding)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Curation workflow (review queue, approve/reject with reason) common for all curated artifacts
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Stored with the artifact - Header.Curated remains the flag used by GoldenCheetah
+type CommonEntityCuration struct {
+	State      string
+	Reason     string    `datastore:",noindex"`
+	ReviewedBy string    `datastore:",noindex"`
+	ReviewDate time.Time `datastore:",noindex"`
+}
+
+const (
+	curationState_Pending  = "pending"
+	curationState_Approved = "approved"
+	curationState_Rejected = "rejected"
+)
+
+// API View of the curation state (e.g. for the author to see why an artifact was rejected)
+type CurationAPIv1 struct {
+	Id         int64  `json:"id"`
+	State      string `json:"state"`
+	Reason     string `json:"reason"`
+	ReviewedBy string `json:"reviewedBy"`
+	ReviewDate string `json:"reviewDate"`
+}
+
+// Review decision of a curator
+type CurationReviewAPIv1 struct {
+	Decision  string `json:"decision"`
+	Reason    string `json:"reason"`
+	CuratorId string `json:"curatorId"`
+}
+
+const (
+	curationDecision_Approve = "approve"
+	curationDecision_Reject  = "reject"
+)
+
+func mapDBtoAPICuration(header *CommonEntityHeader, db *CommonEntityCuration, api *CurationAPIv1) {
+	api.State = curationState(header, db)
+	api.Reason = db.Reason
+	api.ReviewedBy = db.ReviewedBy
+	if !db.ReviewDate.IsZero() {
+		api.ReviewDate = db.ReviewDate.Format(dateTimeLayout)
+	}
+}
+
+// curationState returns the state - artifacts stored before the workflow was
+// introduced only have the Curated flag
+func curationState(header *CommonEntityHeader, db *CommonEntityCuration) string {
+	if db.State != "" {
+		return db.State
+	}
+	if header.Curated {
+		return curationState_Approved
+	}
+	return curationState_Pending
+}
+
+// initCuration sets the state of a new artifact, artifacts of curators are approved automatically
+func initCuration(header *CommonEntityHeader, db *CommonEntityCuration) {
+	*db = CommonEntityCuration{State: curationState_Pending}
+	if header.Curated {
+		db.State = curationState_Approved
+		db.ReviewedBy = header.CreatorId
+		db.ReviewDate = time.Now()
+	}
+}
+
+// setCuration is used by the plain curated true/false endpoints
+func setCuration(header *CommonEntityHeader, db *CommonEntityCuration, curated bool, curatorId string) {
+	header.Curated = curated
+	db.State = curationState_Pending
+	if curated {
+		db.State = curationState_Approved
+	}
+	db.Reason = ""
+	db.ReviewedBy = curatorId
+	db.ReviewDate = time.Now()
+}
+
+// readCurationReview reads and validates the review decision, false is returned if the
+// request is already answered
+func readCurationReview(request *restful.Request, response *restful.Response) (*CurationReviewAPIv1, bool) {
+	review := new(CurationReviewAPIv1)
+	if err := request.ReadEntity(review); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return nil, false
+	}
+
+	switch review.Decision {
+	case curationDecision_Approve:
+	case curationDecision_Reject:
+		if review.Reason == "" {
+			addInvalidRequestError(response, "Mandatory reason for reject is missing", nil)
+			return nil, false
+		}
+	default:
+		addInvalidRequestError(response, "Invalid decision - must be 'approve' or 'reject'", nil)
+		return nil, false
+	}
+
+	if review.CuratorId == "" {
+		addInvalidRequestError(response, "Mandatory curatorId is missing", nil)
+		return nil, false
+	}
+
+	return review, true
+}
+
+// checkCurationPermission answers the request with 403 (and returns false) if the curator
+// is not allowed to curate the artifact
+func checkCurationPermission(ctx context.Context, response *restful.Response, curatorId string, kind string, sport string) bool {
+	if curatorId == "" {
+		addInvalidRequestError(response, "Mandatory curatorId is missing", nil)
+		return false
+	}
+	if !isCurator(ctx, curatorId, kind, sport) {
+		addErrorResponse(response, http.StatusForbidden, errorCode_Forbidden, "Curator is not allowed to curate this artifact", curatorId)
+		return false
+	}
+	return true
+}
+
+// applyCurationReview records the decision on the artifact
+func applyCurationReview(review *CurationReviewAPIv1, header *CommonEntityHeader, db *CommonEntityCuration) {
+	if review.Decision == curationDecision_Approve {
+		header.Curated = true
+		db.State = curationState_Approved
+	} else {
+		header.Curated = false
+		db.State = curationState_Rejected
+	}
+	db.Reason = review.Reason
+	db.ReviewedBy = review.CuratorId
+	db.ReviewDate = time.Now()
+	header.LastChanged = time.Now()
+}
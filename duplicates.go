@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Content deduplication for gcharts and user metrics
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Group of artifacts which are possibly duplicates of each other
+type DuplicateGroupAPIv1 struct {
+	Reason  string              `json:"reason"`
+	Headers []CommonAPIHeaderV1 `json:"headers"`
+}
+
+type DuplicateGroupAPIv1List []DuplicateGroupAPIv1
+
+// Result of one content hash migration call
+type ContentHashMigrationAPIv1 struct {
+	Processed int    `json:"processed"`
+	Migrated  int    `json:"migrated"`
+	Cursor    string `json:"cursor"` // empty if all artifacts are processed
+}
+
+// Only the attributes needed to group duplicates - the definitions and images are not
+// kept in memory when all artifacts are listed
+type duplicateCandidateEntity struct {
+	Header      CommonEntityHeader
+	ContentHash string
+}
+
+const (
+	duplicateReason_Content = "content" // same normalized definition
+	duplicateReason_Name    = "name"    // same normalized name
+)
+
+// values of the "duplicate" query parameter on POST
+const (
+	duplicate_Reject = "reject" // respond 409 with the id of the existing artifact
+	duplicate_Flag   = "flag"   // default - store anyway, the id of the existing artifact is returned in a header
+)
+
+const duplicateOfHeader = "X-Duplicate-Of"
+
+// normalizeContent removes differences which do not change the meaning of
+// a definition (line endings, indentation, trailing blanks and empty lines)
+func normalizeContent(content string) string {
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	normalized := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			normalized = append(normalized, line)
+		}
+	}
+	return strings.Join(normalized, "\n")
+}
+
+// contentHash returns the hash of the normalized content
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(normalizeContent(content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeName is used to group artifacts which only differ in case or blanks of the name
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// findDuplicate returns the key of a not deleted entity of the kind with the same content hash (or nil)
+func findDuplicate(ctx context.Context, kind string, hash string) (*datastore.Key, error) {
+	q := datastore.NewQuery(kind).Filter("ContentHash =", hash).Filter("Header.Deleted =", false).KeysOnly().Limit(1)
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// checkDuplicate handles the "duplicate" query parameter for inserts and returns false
+// if the request is already answered (rejected duplicate or error)
+func checkDuplicate(ctx context.Context, request *restful.Request, response *restful.Response, kind string, hash string) bool {
+	mode := request.QueryParameter("duplicate")
+	switch mode {
+	case "":
+		mode = duplicate_Flag
+	case duplicate_Reject, duplicate_Flag:
+	default:
+		addInvalidRequestError(response, "Invalid duplicate - must be 'reject' or 'flag'", nil)
+		return false
+	}
+
+	existingKey, err := findDuplicate(ctx, kind, hash)
+	if err != nil {
+		// don't block uploads due to problems in the duplicate check
+		log.Warningf(ctx, "Duplicate check for %s failed: %v", kind, err)
+		return true
+	}
+	if existingKey == nil {
+		return true
+	}
+
+	existingId := strconv.FormatInt(existingKey.IntID(), 10)
+	response.AddHeader(duplicateOfHeader, existingId)
+	if mode == duplicate_Reject {
+		addErrorResponse(response, http.StatusConflict, errorCode_Duplicate, "Identical content already exists", existingId)
+		return false
+	}
+	return true
+}
+
+// getDuplicates lists the groups of possible duplicates of the not deleted artifacts of the kind -
+// artifacts stored before the content hash was introduced are only grouped by name until
+// the content hash migration has been run
+func getDuplicates(request *restful.Request, response *restful.Response, kind string, entity string) {
+	ctx := appengine.NewContext(request.Request)
+
+	if !checkCurationPermission(ctx, response, request.QueryParameter("curatorId"), kind, "") {
+		return
+	}
+
+	headers := []CommonAPIHeaderV1{}
+	hashes := []string{}
+	t := datastore.NewQuery(entity).Filter("Header.Deleted =", false).Run(ctx)
+	for {
+		var candidateDB duplicateCandidateEntity
+		key, err := t.Next(&candidateDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		var header CommonAPIHeaderV1
+		mapDBtoAPICommonHeader(&candidateDB.Header, &header)
+		header.Id = key.IntID()
+		headers = append(headers, header)
+		hashes = append(hashes, candidateDB.ContentHash)
+	}
+
+	headerRefs := make([]*CommonAPIHeaderV1, len(headers))
+	for i := range headers {
+		headerRefs[i] = &headers[i]
+	}
+	addRatingAggregates(ctx, kind, headerRefs)
+
+	response.WriteHeaderAndEntity(http.StatusOK, groupDuplicates(headers, hashes))
+}
+
+// groupDuplicates returns groups of headers sharing the same hash or the same normalized name
+func groupDuplicates(headers []CommonAPIHeaderV1, hashes []string) DuplicateGroupAPIv1List {
+	byHash := make(map[string][]CommonAPIHeaderV1)
+	byName := make(map[string][]CommonAPIHeaderV1)
+	for i, header := range headers {
+		if hashes[i] != "" {
+			byHash[hashes[i]] = append(byHash[hashes[i]], header)
+		}
+		byName[normalizeName(header.Name)] = append(byName[normalizeName(header.Name)], header)
+	}
+
+	groups := DuplicateGroupAPIv1List{}
+	for _, group := range byHash {
+		if len(group) > 1 {
+			groups = append(groups, DuplicateGroupAPIv1{Reason: duplicateReason_Content, Headers: group})
+		}
+	}
+	for _, group := range byName {
+		if len(group) > 1 {
+			groups = append(groups, DuplicateGroupAPIv1{Reason: duplicateReason_Name, Headers: group})
+		}
+	}
+
+	// stable order - content duplicates first, then by the oldest id in the group
+	for _, group := range groups {
+		sort.Slice(group.Headers, func(i, j int) bool { return group.Headers[i].Id < group.Headers[j].Id })
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Reason != groups[j].Reason {
+			return groups[i].Reason == duplicateReason_Content
+		}
+		return groups[i].Headers[0].Id < groups[j].Headers[0].Id
+	})
+	return groups
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContentHash(t *testing.T) {
+	base := "<chart>\n  <series name=\"a\"/>\n</chart>"
+
+	tests := []struct {
+		name    string
+		content string
+		same    bool
+	}{
+		{"identical", base, true},
+		{"windows line endings", "<chart>\r\n  <series name=\"a\"/>\r\n</chart>", true},
+		{"indentation", "<chart>\n\t\t<series name=\"a\"/>\n</chart>", true},
+		{"trailing blanks", "<chart>  \n  <series name=\"a\"/>\t\n</chart> ", true},
+		{"empty lines", "\n<chart>\n\n  <series name=\"a\"/>\n   \n</chart>\n\n", true},
+		{"changed value", "<chart>\n  <series name=\"b\"/>\n</chart>", false},
+		{"blanks within a line", "<chart>\n  <series  name=\"a\"/>\n</chart>", false},
+		{"joined lines", "<chart><series name=\"a\"/></chart>", false},
+	}
+
+	want := contentHash(base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentHash(tt.content) == want; got != tt.same {
+				t.Errorf("same hash = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Power Zones", "power zones"},
+		{"  power   ZONES ", "power zones"},
+		{"Power\tZones", "power zones"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGroupDuplicates(t *testing.T) {
+	header := func(id int64, name string) CommonAPIHeaderV1 {
+		return CommonAPIHeaderV1{Id: id, Name: name}
+	}
+	ids := func(groups DuplicateGroupAPIv1List) [][]int64 {
+		result := [][]int64{}
+		for _, group := range groups {
+			var groupIds []int64
+			for _, h := range group.Headers {
+				groupIds = append(groupIds, h.Id)
+			}
+			result = append(result, groupIds)
+		}
+		return result
+	}
+	reasons := func(groups DuplicateGroupAPIv1List) []string {
+		result := []string{}
+		for _, group := range groups {
+			result = append(result, group.Reason)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name        string
+		headers     []CommonAPIHeaderV1
+		hashes      []string
+		wantIds     [][]int64
+		wantReasons []string
+	}{
+		{"none", nil, nil, [][]int64{}, []string{}},
+		{"unique", []CommonAPIHeaderV1{header(1, "A"), header(2, "B")}, []string{"h1", "h2"}, [][]int64{}, []string{}},
+		{"same content", []CommonAPIHeaderV1{header(5, "A"), header(2, "B"), header(3, "C")}, []string{"h1", "h1", "h2"},
+			[][]int64{{2, 5}}, []string{duplicateReason_Content}},
+		{"same name", []CommonAPIHeaderV1{header(4, "Power Zones"), header(1, " power  zones")}, []string{"h1", "h2"},
+			[][]int64{{1, 4}}, []string{duplicateReason_Name}},
+		{"no hash is no content duplicate", []CommonAPIHeaderV1{header(1, "A"), header(2, "B")}, []string{"", ""},
+			[][]int64{}, []string{}},
+		{"content before name, oldest first", []CommonAPIHeaderV1{header(1, "X"), header(2, "x"), header(7, "Y"), header(8, "Z")},
+			[]string{"h1", "h2", "h3", "h3"}, [][]int64{{7, 8}, {1, 2}}, []string{duplicateReason_Content, duplicateReason_Name}},
+		{"both reasons", []CommonAPIHeaderV1{header(3, "A"), header(9, "a")}, []string{"h1", "h1"},
+			[][]int64{{3, 9}, {3, 9}}, []string{duplicateReason_Content, duplicateReason_Name}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := groupDuplicates(tt.headers, tt.hashes)
+			if got := ids(groups); !reflect.DeepEqual(got, tt.wantIds) {
+				t.Errorf("ids = %v, want %v", got, tt.wantIds)
+			}
+			if got := reasons(groups); !reflect.DeepEqual(got, tt.wantReasons) {
+				t.Errorf("reasons = %v, want %v", got, tt.wantReasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Short comment of a user on a gchart/usermetric (commententity) which is stored in DB - every comment
+// is its own entity group, so comments don't contend with the uploads
+// ---------------------------------------------------------------------------------------------------------------//
+type CommentEntity struct {
+	ArtifactKind string
+	ArtifactId   int64
+	CreatorId    string
+	Text         string `datastore:",noindex"`
+	CreateDate   time.Time
+	Deleted      bool
+	DeletedBy    string    // indexed for the data export/erasure of the user (see "privacy.go")
+	DeleteDate   time.Time `datastore:",noindex"`
+}
+
+const commentMaxLength = 500
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Structure for POST
+type CommentPostAPIv1 struct {
+	CreatorId string `json:"creatorId"`
+	Text      string `json:"text"`
+}
+
+type CommentGetAPIv1 struct {
+	Id         int64  `json:"id"`
+	CreatorId  string `json:"creatorId"`
+	Text       string `json:"text"`
+	CreateDate string `json:"createDate"`
+}
+
+type CommentGetAPIv1List []CommentGetAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const commentDBEntity = "commententity"
+
+func mapDBtoAPIComment(db *CommentEntity, api *CommentGetAPIv1) {
+	api.CreatorId = db.CreatorId
+	api.Text = db.Text
+	api.CreateDate = db.CreateDate.Format(dateTimeLayout)
+}
+
+// loadComment returns the comment, which must belong to the artifact
+func loadComment(ctx context.Context, kind string, id int64, commentId int64) (*datastore.Key, *CommentEntity, error) {
+	key := datastore.NewKey(ctx, commentDBEntity, "", commentId, nil)
+	commentDB := new(CommentEntity)
+	if err := datastore.Get(ctx, key, commentDB); err != nil && !isErrFieldMismatch(err) {
+		return nil, nil, err
+	}
+	if commentDB.ArtifactKind != kind || commentDB.ArtifactId != id {
+		return nil, nil, datastore.ErrNoSuchEntity
+	}
+	return key, commentDB, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertComment(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	kind, id, ok := readArtifactPath(request, response)
+	if !ok {
+		return
+	}
+
+	comment := new(CommentPostAPIv1)
+	if err := request.ReadEntity(comment); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+	if comment.CreatorId == "" || comment.Text == "" {
+		addInvalidRequestError(response, "Mandatory creatorId or text is missing", nil)
+		return
+	}
+	if utf8.RuneCountInString(comment.Text) > commentMaxLength {
+		addInvalidRequestError(response, fmt.Sprintf("Text too long - maximum is %d characters", commentMaxLength), nil)
+		return
+	}
+
+	if _, _, _, _, err := loadArtifact(ctx, kind, id); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	commentDB := new(CommentEntity)
+	commentDB.ArtifactKind = kind
+	commentDB.ArtifactId = id
+	commentDB.CreatorId = comment.CreatorId
+	commentDB.Text = comment.Text
+	commentDB.CreateDate = time.Now()
+
+	key := datastore.NewIncompleteKey(ctx, commentDBEntity, nil)
+	key, err := datastore.Put(ctx, key, commentDB)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
+}
+
+// getComment lists the (not deleted) comments of an artifact, oldest first
+func getComment(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	kind, id, ok := readArtifactPath(request, response)
+	if !ok {
+		return
+	}
+
+	if _, _, _, _, err := loadArtifact(ctx, kind, id); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	q := datastore.NewQuery(commentDBEntity).
+		Filter("ArtifactKind =", kind).
+		Filter("ArtifactId =", id).
+		Filter("Deleted =", false)
+	var commentsOnDBList []CommentEntity
+	keys, err := q.GetAll(ctx, &commentsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back
+	commentList := CommentGetAPIv1List{}
+	for i, commentDB := range commentsOnDBList {
+		var commentAPI CommentGetAPIv1
+		mapDBtoAPIComment(&commentDB, &commentAPI)
+		commentAPI.Id = keys[i].IntID()
+		commentList = append(commentList, commentAPI)
+	}
+
+	// sorted here to avoid a composite index
+	sort.SliceStable(commentList, func(i, j int) bool {
+		return commentList[i].CreateDate < commentList[j].CreateDate
+	})
+
+	response.WriteHeaderAndEntity(http.StatusOK, commentList)
+}
+
+// deleteComment is a soft delete which is allowed for the author and for curators of the artifact
+func deleteComment(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	kind, id, ok := readArtifactPath(request, response)
+	if !ok {
+		return
+	}
+
+	commentId, err := strconv.ParseInt(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	creatorId := request.QueryParameter("creatorId")
+	if creatorId == "" {
+		addInvalidRequestError(response, "Mandatory creatorId is missing", nil)
+		return
+	}
+
+	_, _, _, sport, err := loadArtifact(ctx, kind, id)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	key, commentDB, err := loadComment(ctx, kind, id, commentId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	if commentDB.CreatorId != creatorId && !isCurator(ctx, creatorId, kind, sport) {
+		addErrorResponse(response, http.StatusForbidden, errorCode_Forbidden, "Only the author or a curator may delete the comment", creatorId)
+		return
+	}
+
+	if !commentDB.Deleted {
+		commentDB.Deleted = true
+		commentDB.DeletedBy = creatorId
+		commentDB.DeleteDate = time.Now()
+		if _, err := datastore.Put(ctx, key, commentDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
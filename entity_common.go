@@ -19,13 +19,10 @@
 package main
 
 import (
-	"net/http"
 	"time"
 
-	"google.golang.org/appengine"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-
-	"github.com/emicklei/go-restful"
 )
 
 
@@ -41,6 +38,7 @@ type CommonEntityHeader struct {
 	CreatorId   string
 	Curated     bool
 	Deleted     bool
+	Hidden      bool  // hidden after abuse reports - pending curator review
 }
 
 // Internal Structure for Header
@@ -55,6 +53,9 @@ type CommonAPIHeaderV1 struct {
 	Language    string      `json:"language"`
 	Curated     bool        `json:"curated"`
 	Deleted     bool        `json:"deleted"`
+	Hidden      bool        `json:"hidden"`
+	RatingAverage float64   `json:"ratingAverage"` // GET only
+	RatingCount int         `json:"ratingCount"`   // GET only (from the rating counters, see "entity_rating.go")
 }
 
 func mapAPItoDBCommonHeader(api *CommonAPIHeaderV1, db *CommonEntityHeader) {
@@ -77,24 +78,51 @@ func mapDBtoAPICommonHeader(db *CommonEntityHeader, api *CommonAPIHeaderV1) {
 	api.CreatorId = db.CreatorId
 	api.Curated = db.Curated
 	api.Deleted = db.Deleted
+	api.Hidden = db.Hidden
 }
 
-func commonResponseErrorProcessing(response *restful.Response, err error) {
-	switch {
-	case appengine.IsOverQuota(err):
-		// return 503 and a text similar to what GAE is returning as well
-		addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-	case err == datastore.ErrNoSuchEntity:
-		addPlainTextError(response, http.StatusNotFound, err.Error())
-	default:
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
-	}
+// preserveCommonHeader keeps the server maintained attributes on PUT of an artifact
+func preserveCommonHeader(current *CommonEntityHeader, db *CommonEntityHeader) {
+	db.Hidden = current.Hidden
 }
 
-
+// mapDBtoAPICommonHeaderForListing is used for the header listings which GoldenCheetah
+// synchronizes - hidden artifacts are reported as deleted there, so they disappear
+func mapDBtoAPICommonHeaderForListing(db *CommonEntityHeader, api *CommonAPIHeaderV1) {
+	mapDBtoAPICommonHeader(db, api)
+	if db.Hidden {
+		api.Deleted = true
+	}
+}
 
 // ignore missing fields error when mapping to Header struct
 func isErrFieldMismatch(err error) bool {
 	_, ok := err.(*datastore.ErrFieldMismatch)
 	return ok
-}
\ No newline at end of file
+}
+
+// loadArtifact returns the key, the entity (for a later Put), its header and
+// the sport (for the curator permission) of a gchart or user metric
+func loadArtifact(ctx context.Context, kind string, id int64) (*datastore.Key, interface{}, *CommonEntityHeader, string, error) {
+	switch kind {
+	case artifactKind_GChart:
+		key := datastore.NewKey(ctx, gChartDBEntity, "", id, gchartEntityRootKey(ctx))
+		chartDB := new(GChartEntity)
+		if err := datastore.Get(ctx, key, chartDB); err != nil && !isErrFieldMismatch(err) {
+			return nil, nil, nil, "", err
+		}
+		return key, chartDB, &chartDB.Header, chartDB.ChartSport, nil
+	case artifactKind_UserMetric:
+		key := datastore.NewKey(ctx, usermetricDBEntity, "", id, usermetricEntityRootKey(ctx))
+		metricDB := new(UserMetricEntity)
+		if err := datastore.Get(ctx, key, metricDB); err != nil && !isErrFieldMismatch(err) {
+			return nil, nil, nil, "", err
+		}
+		return key, metricDB, &metricDB.Header, "", nil
+	}
+	return nil, nil, nil, "", datastore.ErrInvalidEntityType
+}
+
+func isArtifactKind(kind string) bool {
+	return kind == artifactKind_GChart || kind == artifactKind_UserMetric
+}
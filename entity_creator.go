@@ -0,0 +1,321 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	b64 "encoding/base64"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Profile of a creator of charts/metrics (creatorentity) which is stored in DB - the key is the CreatorId
+// ---------------------------------------------------------------------------------------------------------------//
+type CreatorEntity struct {
+	Nickname    string    `datastore:",noindex"`
+	Email       string    `datastore:",noindex"`
+	Avatar      []byte    `datastore:",noindex"` // PNG, scaled down like a chart thumbnail
+	LastChanged time.Time `datastore:",noindex"`
+	SecretHash  string    `datastore:",noindex"` // hash of the creator secret - see checkCreatorSecret()
+}
+
+// The CreatorId is part of all listings, so it can't prove that a request comes from the creator.
+// GoldenCheetah sends a secret only known to the installation of the creator with the uploads and the
+// profile - it is stored (hashed) when the profile is created and required for all changes afterwards.
+// Profiles created without a secret only get one bound by an admin.
+const creatorSecretHeader = "X-Creator-Secret"
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Full structure for GET and PUT
+type CreatorAPIv1 struct {
+	CreatorId   string `json:"creatorId"`
+	Nickname    string `json:"nickname"`
+	Email       string `json:"email"`
+	Avatar      string `json:"avatar,omitempty"` // base64 - PNG or JPEG on PUT, PNG on GET
+	LastChanged string `json:"lastChange"`       // GET only
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const creatorDBEntity = "creatorentity"
+const creatorDBEntityRootKey = "creatorroot"
+
+// mapAPItoDBCreator returns an *imageRejectedError if the avatar can not be accepted
+func mapAPItoDBCreator(api *CreatorAPIv1, db *CreatorEntity) error {
+	db.Nickname = api.Nickname
+	db.Email = api.Email
+	db.Avatar = nil
+	if api.Avatar == "" {
+		return nil
+	}
+	data, err := b64.StdEncoding.DecodeString(api.Avatar)
+	if err != nil {
+		return &imageRejectedError{http.StatusBadRequest, "Avatar is not valid base64", err}
+	}
+	if _, err := validateImage(data); err != nil {
+		return err
+	}
+	db.Avatar, err = createThumbnail(data)
+	return err
+}
+
+func mapDBtoAPICreator(db *CreatorEntity, api *CreatorAPIv1) {
+	api.Nickname = db.Nickname
+	api.Email = db.Email
+	if len(db.Avatar) > 0 {
+		api.Avatar = b64.StdEncoding.EncodeToString(db.Avatar)
+	}
+	api.LastChanged = db.LastChanged.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+// creatorEntityRootKey returns the key used for all creatorEntity entries.
+func creatorEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, creatorDBEntity, creatorDBEntityRootKey, 0, nil)
+}
+
+func creatorEntityKey(ctx context.Context, creatorId string) *datastore.Key {
+	return datastore.NewKey(ctx, creatorDBEntity, creatorId, 0, creatorEntityRootKey(ctx))
+}
+
+// loadCreator returns nil (without error) if the creator has no profile yet
+func loadCreator(ctx context.Context, creatorId string) (*CreatorEntity, error) {
+	if creatorId == "" {
+		return nil, nil
+	}
+	creatorDB := new(CreatorEntity)
+	err := datastore.Get(ctx, creatorEntityKey(ctx, creatorId), creatorDB)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	return creatorDB, nil
+}
+
+// ensureCreator creates the profile from the data sent with an upload if the creator has none
+// yet, the secret sent with the upload (if any) is bound to it. Profiles without a secret follow
+// nickname/email of the uploads, a profile with a secret is only changed by its PUT.
+func ensureCreator(ctx context.Context, creatorId string, nickname string, email string, secret string) {
+	if creatorId == "" {
+		return
+	}
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := creatorEntityKey(tc, creatorId)
+		creatorDB := new(CreatorEntity)
+		err := datastore.Get(tc, key, creatorDB)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			if secret != "" {
+				creatorDB.SecretHash = creatorSecretHash(secret)
+			}
+		case err != nil && !isErrFieldMismatch(err):
+			return err
+		case creatorDB.SecretHash != "" || (creatorDB.Nickname == nickname && creatorDB.Email == email):
+			return nil
+		}
+		creatorDB.Nickname = nickname
+		creatorDB.Email = email
+		creatorDB.LastChanged = time.Now()
+		_, err = datastore.Put(tc, key, creatorDB)
+		return err
+	}, nil)
+	if err != nil {
+		// the upload itself is fine, the profile is created with the next one
+		log.Warningf(ctx, "Creating profile of creator %s failed: %v", creatorId, err)
+	}
+}
+
+// resolveCreator replaces the nickname/email copied onto an artifact by the ones of the
+// creator profile (if there is one)
+func resolveCreator(ctx context.Context, creatorId string, nickname *string, email *string) {
+	creatorDB, err := loadCreator(ctx, creatorId)
+	if err != nil {
+		log.Warningf(ctx, "Reading profile of creator %s failed: %v", creatorId, err)
+		return
+	}
+	if creatorDB == nil {
+		return
+	}
+	*nickname = creatorDB.Nickname
+	*email = creatorDB.Email
+}
+
+func creatorSecretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkCreatorSecret is true if the secret is the one stored with the profile - profiles
+// without a secret (created by an upload) have no owner yet
+func checkCreatorSecret(creatorDB *CreatorEntity, secret string) bool {
+	if creatorDB == nil || creatorDB.SecretHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(creatorDB.SecretHash), []byte(creatorSecretHash(secret))) == 1
+}
+
+// isCreatorRequest is true if the request is sent by the creator (secret of the profile) or by an admin
+func isCreatorRequest(ctx context.Context, request *restful.Request, creatorId string) bool {
+	if requestAdmin(request) != "" {
+		return true
+	}
+	secret := request.HeaderParameter(creatorSecretHeader)
+	if secret == "" {
+		return false
+	}
+	creatorDB, err := loadCreator(ctx, creatorId)
+	if err != nil {
+		log.Warningf(ctx, "Reading profile of creator %s failed: %v", creatorId, err)
+		return false
+	}
+	return checkCreatorSecret(creatorDB, secret)
+}
+
+// canSeeCreatorEmail is true if the email of the creator of an artifact may be returned - to the
+// creator, an admin or a curator of the artifact
+func canSeeCreatorEmail(ctx context.Context, request *restful.Request, creatorId string, kind string, sport string) bool {
+	if isCreatorRequest(ctx, request, creatorId) {
+		return true
+	}
+	curatorId := request.QueryParameter("curatorId")
+	return curatorId != "" && isCurator(ctx, curatorId, kind, sport)
+}
+
+// errCreatorForbidden is returned by the transaction if the secret does not match the profile
+type errCreatorForbidden struct{}
+
+func (e *errCreatorForbidden) Error() string {
+	return "Only the creator may change the profile"
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func upsertCreator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	creatorId := request.PathParameter("creatorId")
+
+	creator := new(CreatorAPIv1)
+	if err := request.ReadEntity(creator); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+	if creator.Nickname == "" {
+		addInvalidRequestError(response, "Mandatory nickname is missing", nil)
+		return
+	}
+
+	secret := request.HeaderParameter(creatorSecretHeader)
+	admin := requestAdmin(request) != ""
+	if secret == "" && !admin {
+		addInvalidRequestError(response, "Mandatory header "+creatorSecretHeader+" is missing", nil)
+		return
+	}
+
+	creatorDB := new(CreatorEntity)
+	if err := mapAPItoDBCreator(creator, creatorDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	creatorDB.LastChanged = time.Now()
+
+	// the secret is bound when the profile is created - an existing profile is only changed with
+	// its secret, a profile without one (created by an upload) only by an admin, who binds the
+	// secret sent with the request (if any)
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := creatorEntityKey(tc, creatorId)
+		currentDB := new(CreatorEntity)
+		err := datastore.Get(tc, key, currentDB)
+		if err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+			return err
+		}
+		exists := err != datastore.ErrNoSuchEntity
+		creatorDB.SecretHash = currentDB.SecretHash
+		if exists && !admin && !checkCreatorSecret(currentDB, secret) {
+			return &errCreatorForbidden{}
+		}
+		if secret != "" && (!exists || (admin && currentDB.SecretHash == "")) {
+			creatorDB.SecretHash = creatorSecretHash(secret)
+		}
+		_, err = datastore.Put(tc, key, creatorDB)
+		return err
+	}, nil)
+	if _, ok := err.(*errCreatorForbidden); ok {
+		addErrorResponse(response, http.StatusForbidden, errorCode_Forbidden, err.Error(), creatorId)
+		return
+	}
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getCreator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	creatorId := request.PathParameter("creatorId")
+
+	creatorDB, err := loadCreator(ctx, creatorId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if creatorDB == nil {
+		commonResponseErrorProcessing(response, datastore.ErrNoSuchEntity)
+		return
+	}
+
+	creator := new(CreatorAPIv1)
+	mapDBtoAPICreator(creatorDB, creator)
+	creator.CreatorId = creatorId
+	if !isCreatorRequest(ctx, request, creatorId) {
+		creator.Email = ""
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, creator)
+}
+
+// includeDeletedForOwner is true if the owner (or an admin) asks for the own uploads, only
+// then deleted and hidden artifacts are part of the listing
+func includeDeletedForOwner(ctx context.Context, request *restful.Request) bool {
+	return isCreatorRequest(ctx, request, request.PathParameter("creatorId"))
+}
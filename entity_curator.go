@@ -20,7 +20,10 @@ package main
 
 import (
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -38,9 +41,40 @@ type CuratorEntity struct {
 	CuratorId       string
 	Nickname	string
 	Email           string
+	Role            string
+	ArtifactKinds   []string     `datastore:",noindex"` // empty = all kinds
+	Sports          []string     `datastore:",noindex"` // empty = all sports - only limits charts with a sport
+}
+
+// Roles of a curator
+const (
+	curatorRole_Curator = "curator"
+	curatorRole_Admin   = "admin"
+)
+
+// Artifact kinds a curator can be scoped to
+const (
+	artifactKind_GChart     = "gchart"
+	artifactKind_UserMetric = "usermetric"
+)
 
+// Audit trail of all changes of curators (curatorauditentity)
+type CuratorAuditEntity struct {
+	Action     string
+	CuratorId  string
+	Nickname   string       `datastore:",noindex"`
+	Email      string       `datastore:",noindex"`
+	Role       string       `datastore:",noindex"`
+	ChangedBy  string
+	ChangeDate time.Time
 }
 
+const (
+	curatorAudit_Add    = "add"
+	curatorAudit_Update = "update"
+	curatorAudit_Remove = "remove"
+)
+
 // ---------------------------------------------------------------------------------------------------------------//
 // API View Definition
 // ---------------------------------------------------------------------------------------------------------------//
@@ -51,10 +85,32 @@ type CuratorAPIv1 struct {
 	CuratorId       string      `json:"curatorId"`
 	Nickname        string      `json:"nickname"`
 	Email           string      `json:"email"`
+	Role            string      `json:"role"`
+	ArtifactKinds   []string    `json:"artifactKinds"`
+	Sports          []string    `json:"sports"` // does not limit user metrics (they have no sport)
 }
 
 type CuratorAPIv1List []CuratorAPIv1
 
+type CuratorAuditAPIv1 struct {
+	Action     string `json:"action"`
+	CuratorId  string `json:"curatorId"`
+	Nickname   string `json:"nickname"`
+	Email      string `json:"email"`
+	Role       string `json:"role"`
+	ChangedBy  string `json:"changedBy"`
+	ChangeDate string `json:"changeDate"`
+}
+
+type CuratorAuditAPIv1List []CuratorAuditAPIv1
+
+// Result of the merge of curators with the same CuratorId
+type CuratorMigrationAPIv1 struct {
+	Merged    int      `json:"merged"`    // CuratorIds which had more than one curator
+	Removed   int      `json:"removed"`   // curators merged into another one
+	Conflicts []string `json:"conflicts"` // CuratorIds not merged - the scopes differ, fix them with PUT/DELETE /curator/{id}
+}
+
 
 // ---------------------------------------------------------------------------------------------------------------//
 // Data Storage View
@@ -62,12 +118,37 @@ type CuratorAPIv1List []CuratorAPIv1
 
 const curatorDBEntity = "curatorentity"
 const curatorDBEntityRootKey = "curatorroot"
+const curatorAuditDBEntity = "curatorauditentity"
 
 
+// validateCurator returns the reason why the curator can not be stored or ""
+func validateCurator(api *CuratorAPIv1) string {
+	if api.CuratorId == "" {
+		return "Mandatory CuratorId is missing"
+	}
+	switch api.Role {
+	case "", curatorRole_Curator, curatorRole_Admin:
+	default:
+		return "Invalid role - must be 'curator' or 'admin'"
+	}
+	for _, kind := range api.ArtifactKinds {
+		if !isArtifactKind(kind) {
+			return "Invalid artifactKinds - must be 'gchart' or 'usermetric'"
+		}
+	}
+	return ""
+}
+
 func mapAPItoDBCurator(api *CuratorAPIv1, db *CuratorEntity) {
 	db.CuratorId = api.CuratorId
 	db.Nickname = api.Nickname
 	db.Email = api.Email
+	db.Role = api.Role
+	if db.Role == "" {
+		db.Role = curatorRole_Curator
+	}
+	db.ArtifactKinds = api.ArtifactKinds
+	db.Sports = api.Sports
 }
 
 
@@ -75,6 +156,23 @@ func mapDBtoAPICurator(db *CuratorEntity, api *CuratorAPIv1 ) {
 	api.CuratorId = db.CuratorId
 	api.Nickname = db.Nickname
 	api.Email = db.Email
+	api.Role = db.Role
+	if api.Role == "" {
+		// curators stored before roles were introduced
+		api.Role = curatorRole_Curator
+	}
+	api.ArtifactKinds = db.ArtifactKinds
+	api.Sports = db.Sports
+}
+
+func mapDBtoAPICuratorAudit(db *CuratorAuditEntity, api *CuratorAuditAPIv1) {
+	api.Action = db.Action
+	api.CuratorId = db.CuratorId
+	api.Nickname = db.Nickname
+	api.Email = db.Email
+	api.Role = db.Role
+	api.ChangedBy = db.ChangedBy
+	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
 }
 
 
@@ -85,6 +183,107 @@ func curatorEntityRootKey(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, curatorDBEntity, curatorDBEntityRootKey, 0, nil)
 }
 
+// isCurator checks if the creator is a registered curator for the artifact kind and
+// sport (errors are treated as "no curator") - sport "" means no sport specific artifact
+func isCurator(ctx context.Context, creatorId string, kind string, sport string) bool {
+	curatorOnDBList, err := loadCurators(ctx, creatorId)
+	return err == nil && isAnyScopedTo(curatorOnDBList, kind, sport)
+}
+
+// loadCurators returns the curators of a CuratorId - more than one only if stored before
+// the CuratorId had to be unique
+func loadCurators(ctx context.Context, creatorId string) ([]CuratorEntity, error) {
+	if creatorId == "" {
+		return nil, nil
+	}
+	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", creatorId)
+	var curatorOnDBList []CuratorEntity
+	if _, err := curatorQuery.GetAll(ctx, &curatorOnDBList); err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	return curatorOnDBList, nil
+}
+
+func isAnyScopedTo(curatorOnDBList []CuratorEntity, kind string, sport string) bool {
+	for _, curatorDB := range curatorOnDBList {
+		if curatorDB.isScopedTo(kind, sport) {
+			return true
+		}
+	}
+	return false
+}
+
+// isScopedTo checks the artifact kinds and sports of the curator - admins curate everything,
+// kind "" is used for checks which are not artifact specific. The sport scope does not apply
+// to artifacts without a sport (user metrics, charts without sport) - they are curated by all
+// curators of the kind, limit a curator to "gchart" to keep them from curating user metrics.
+func (curatorDB *CuratorEntity) isScopedTo(kind string, sport string) bool {
+	if curatorDB.Role == curatorRole_Admin || kind == "" {
+		return true
+	}
+	if len(curatorDB.ArtifactKinds) > 0 && !containsFold(curatorDB.ArtifactKinds, kind) {
+		return false
+	}
+	if len(curatorDB.Sports) > 0 && sport != "" && !containsFold(curatorDB.Sports, sport) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// findCuratorKey returns the key of the curator with the CuratorId or nil - must be called
+// within the transaction which changes curators to make CuratorId unique
+func findCuratorKey(tc context.Context, curatorId string) (*datastore.Key, error) {
+	q := datastore.NewQuery(curatorDBEntity).Ancestor(curatorEntityRootKey(tc)).Filter("CuratorId =", curatorId).KeysOnly().Limit(1)
+	keys, err := q.GetAll(tc, nil)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// addCuratorAudit records the change - audit entries share the ancestor of the curators,
+// so they are written within the same transaction as the change itself
+func addCuratorAudit(tc context.Context, action string, curatorDB *CuratorEntity, changedBy string) error {
+	auditDB := CuratorAuditEntity{
+		Action:     action,
+		CuratorId:  curatorDB.CuratorId,
+		Nickname:   curatorDB.Nickname,
+		Email:      curatorDB.Email,
+		Role:       curatorDB.Role,
+		ChangedBy:  changedBy,
+		ChangeDate: time.Now(),
+	}
+	key := datastore.NewIncompleteKey(tc, curatorAuditDBEntity, curatorEntityRootKey(tc))
+	_, err := datastore.Put(tc, key, &auditDB)
+	return err
+}
+
+// errCuratorExists is returned by the transactions if the CuratorId is already in use
+type errCuratorExists struct {
+	key *datastore.Key
+}
+
+func (e *errCuratorExists) Error() string {
+	return "CuratorId already exists"
+}
+
+func curatorResponseErrorProcessing(response *restful.Response, err error) {
+	if e, ok := err.(*errCuratorExists); ok {
+		addErrorResponse(response, http.StatusConflict, errorCode_Duplicate, "CuratorId already exists", strconv.FormatInt(e.key.IntID(), 10))
+		return
+	}
+	commonResponseErrorProcessing(response, err)
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // request/response handler
 // ---------------------------------------------------------------------------------------------------------------//
@@ -94,26 +293,36 @@ func insertCurator(request *restful.Request, response *restful.Response) {
 
 	curator := new(CuratorAPIv1)
 	if err := request.ReadEntity(curator); err != nil {
-		addPlainTextError(response,http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	if message := validateCurator(curator); message != "" {
+		addInvalidRequestError(response, message, nil)
+		return
+	}
 
 	curatorDB := new(CuratorEntity)
 	mapAPItoDBCurator(curator, curatorDB)
 
-	// and now store it
-	key := datastore.NewIncompleteKey(ctx, curatorDBEntity, curatorEntityRootKey(ctx))
-	key, err := datastore.Put(ctx, key, curatorDB);
-	if  err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	// and now store it (CuratorId must be unique)
+	var key *datastore.Key
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		existingKey, err := findCuratorKey(tc, curatorDB.CuratorId)
+		if err != nil {
+			return err
+		}
+		if existingKey != nil {
+			return &errCuratorExists{existingKey}
 		}
+		key = datastore.NewIncompleteKey(tc, curatorDBEntity, curatorEntityRootKey(tc))
+		if key, err = datastore.Put(tc, key, curatorDB); err != nil {
+			return err
+		}
+		return addCuratorAudit(tc, curatorAudit_Add, curatorDB, requestAdmin(request))
+	}, nil)
+	if err != nil {
+		curatorResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -137,25 +346,248 @@ func getCurator(request *restful.Request, response *restful.Response) {
 	}
 	var curatorOnDBList []CuratorEntity
 	k, err := q.GetAll(ctx, &curatorOnDBList)
-	if err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
-	// DB Entity needs to be mapped back
+	// DB Entity needs to be mapped back (and filtered by role - not all curators have one stored)
+	// the emails are only returned to admins
+	role := request.QueryParameter("role")
+	admin := requestAdmin(request) != ""
 	var curatorList CuratorAPIv1List
 	for i, curatorDB := range curatorOnDBList {
 		var curator CuratorAPIv1
 		mapDBtoAPICurator(&curatorDB, &curator)
 		curator.Id = k[i].IntID()
+		if !admin {
+			curator.Email = ""
+		}
+		if role != "" && curator.Role != role {
+			continue
+		}
 		curatorList = append (curatorList, curator)
 	}
 
 	response.WriteEntity(curatorList)
 }
 
+func updateCurator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	curator := new(CuratorAPIv1)
+	if err := request.ReadEntity(curator); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+
+	if message := validateCurator(curator); message != "" {
+		addInvalidRequestError(response, message, nil)
+		return
+	}
+
+	curatorDB := new(CuratorEntity)
+	mapAPItoDBCurator(curator, curatorDB)
+
+	key := datastore.NewKey(ctx, curatorDBEntity, "", i, curatorEntityRootKey(ctx))
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, key, new(CuratorEntity)); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		existingKey, err := findCuratorKey(tc, curatorDB.CuratorId)
+		if err != nil {
+			return err
+		}
+		if existingKey != nil && !existingKey.Equal(key) {
+			return &errCuratorExists{existingKey}
+		}
+		if _, err := datastore.Put(tc, key, curatorDB); err != nil {
+			return err
+		}
+		return addCuratorAudit(tc, curatorAudit_Update, curatorDB, requestAdmin(request))
+	}, nil)
+	if err != nil {
+		curatorResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func deleteCurator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	key := datastore.NewKey(ctx, curatorDBEntity, "", i, curatorEntityRootKey(ctx))
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		curatorDB := new(CuratorEntity)
+		if err := datastore.Get(tc, key, curatorDB); err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		if err := datastore.Delete(tc, key); err != nil {
+			return err
+		}
+		return addCuratorAudit(tc, curatorAudit_Remove, curatorDB, requestAdmin(request))
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getCuratorAudit(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	q := datastore.NewQuery(curatorAuditDBEntity).Ancestor(curatorEntityRootKey(ctx))
+	if curatorString := request.QueryParameter("curatorId"); curatorString != "" {
+		q = q.Filter("CuratorId =", curatorString)
+	}
+
+	var auditOnDBList []CuratorAuditEntity
+	if _, err := q.GetAll(ctx, &auditOnDBList); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// newest first - sorted here to avoid a composite index
+	sort.Slice(auditOnDBList, func(i, j int) bool {
+		return auditOnDBList[i].ChangeDate.After(auditOnDBList[j].ChangeDate)
+	})
+
+	// DB Entity needs to be mapped back
+	auditList := CuratorAuditAPIv1List{}
+	for _, auditDB := range auditOnDBList {
+		var audit CuratorAuditAPIv1
+		mapDBtoAPICuratorAudit(&auditDB, &audit)
+		auditList = append(auditList, audit)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, auditList)
+}
+
+// migrateCurators merges curators which were stored with the same CuratorId before it had to be
+// unique - the one with the lowest id is kept, the others are removed (with audit entries). Curators
+// with different scopes are kept and reported as conflicts, a merged scope would grant combinations
+// of kinds and sports none of them had
+func migrateCurators(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	var result CuratorMigrationAPIv1
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		result = CuratorMigrationAPIv1{Conflicts: []string{}}
+
+		var curatorOnDBList []CuratorEntity
+		keys, err := datastore.NewQuery(curatorDBEntity).Ancestor(curatorEntityRootKey(tc)).GetAll(tc, &curatorOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+
+		byCuratorId := make(map[string][]int)
+		for i := range curatorOnDBList {
+			byCuratorId[curatorOnDBList[i].CuratorId] = append(byCuratorId[curatorOnDBList[i].CuratorId], i)
+		}
+
+		for curatorId, indexes := range byCuratorId {
+			if len(indexes) < 2 {
+				continue
+			}
+			sort.Slice(indexes, func(i, j int) bool { return keys[indexes[i]].IntID() < keys[indexes[j]].IntID() })
+
+			curators := make([]CuratorEntity, len(indexes))
+			for i, index := range indexes {
+				curators[i] = curatorOnDBList[index]
+			}
+			merged, ok := mergeCurators(curators)
+			if !ok {
+				result.Conflicts = append(result.Conflicts, curatorId)
+				continue
+			}
+
+			for _, i := range indexes[1:] {
+				if err := datastore.Delete(tc, keys[i]); err != nil {
+					return err
+				}
+				if err := addCuratorAudit(tc, curatorAudit_Remove, &curatorOnDBList[i], requestAdmin(request)); err != nil {
+					return err
+				}
+				result.Removed++
+			}
+			if _, err := datastore.Put(tc, keys[indexes[0]], &merged); err != nil {
+				return err
+			}
+			if err := addCuratorAudit(tc, curatorAudit_Update, &merged, requestAdmin(request)); err != nil {
+				return err
+			}
+			result.Merged++
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	sort.Strings(result.Conflicts)
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+// mergeCurators merges the curators into the first one - false if they can't be merged since
+// their scopes differ. The scope of an admin does not matter, admins curate everything.
+func mergeCurators(curators []CuratorEntity) (CuratorEntity, bool) {
+	merged := curators[0]
+	for _, other := range curators[1:] {
+		if other.Role == curatorRole_Admin {
+			merged.Role = curatorRole_Admin
+		}
+		if merged.Nickname == "" {
+			merged.Nickname = other.Nickname
+		}
+		if merged.Email == "" {
+			merged.Email = other.Email
+		}
+	}
+	if merged.Role == curatorRole_Admin {
+		return merged, true
+	}
+	if merged.Role == "" {
+		merged.Role = curatorRole_Curator
+	}
+	for _, other := range curators[1:] {
+		if !sameScope(merged.ArtifactKinds, other.ArtifactKinds) || !sameScope(merged.Sports, other.Sports) {
+			return merged, false
+		}
+	}
+	return merged, true
+}
+
+// sameScope compares the entries ignoring order and case
+func sameScope(scope []string, other []string) bool {
+	for _, entry := range scope {
+		if !containsFold(other, entry) {
+			return false
+		}
+	}
+	for _, entry := range other {
+		if !containsFold(scope, entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+func TestCuratorIsScopedTo(t *testing.T) {
+	all := CuratorEntity{Role: curatorRole_Curator}
+	admin := CuratorEntity{Role: curatorRole_Admin, ArtifactKinds: []string{artifactKind_GChart}, Sports: []string{"Run"}}
+	charts := CuratorEntity{Role: curatorRole_Curator, ArtifactKinds: []string{artifactKind_GChart}}
+	bike := CuratorEntity{Role: curatorRole_Curator, Sports: []string{"Bike"}}
+	bikeMetrics := CuratorEntity{Role: curatorRole_Curator, ArtifactKinds: []string{artifactKind_UserMetric}, Sports: []string{"Bike"}}
+	legacy := CuratorEntity{} // stored before roles and scopes
+
+	tests := []struct {
+		name    string
+		curator CuratorEntity
+		kind    string
+		sport   string
+		want    bool
+	}{
+		{"unscoped chart", all, artifactKind_GChart, "Run", true},
+		{"unscoped metric", all, artifactKind_UserMetric, "", true},
+		{"legacy curator", legacy, artifactKind_UserMetric, "", true},
+		{"admin outside scope", admin, artifactKind_UserMetric, "Swim", true},
+		{"kind in scope", charts, artifactKind_GChart, "Swim", true},
+		{"kind out of scope", charts, artifactKind_UserMetric, "", false},
+		{"sport in scope", bike, artifactKind_GChart, "bike", true},
+		{"sport out of scope", bike, artifactKind_GChart, "Run", false},
+		// the sport scope does not apply to user metrics - only the kind scope does
+		{"artifact without sport", bike, artifactKind_UserMetric, "", true},
+		{"sport scoped chart curator and metric", CuratorEntity{ArtifactKinds: []string{artifactKind_GChart}, Sports: []string{"Run"}}, artifactKind_UserMetric, "", false},
+		{"chart without sport", bike, artifactKind_GChart, "", true},
+		{"metric without sport", bikeMetrics, artifactKind_UserMetric, "", true},
+		{"kind and sport out of scope", bikeMetrics, artifactKind_GChart, "Bike", false},
+		{"not artifact specific", charts, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.curator.isScopedTo(tt.kind, tt.sport); got != tt.want {
+				t.Errorf("isScopedTo(%q, %q) = %v, want %v", tt.kind, tt.sport, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCurator(t *testing.T) {
+	tests := []struct {
+		name    string
+		curator CuratorAPIv1
+		valid   bool
+	}{
+		{"minimal", CuratorAPIv1{CuratorId: "id"}, true},
+		{"scoped admin", CuratorAPIv1{CuratorId: "id", Role: curatorRole_Admin, ArtifactKinds: []string{artifactKind_GChart, artifactKind_UserMetric}}, true},
+		{"missing id", CuratorAPIv1{}, false},
+		{"unknown role", CuratorAPIv1{CuratorId: "id", Role: "Admin"}, false},
+		{"unknown kind", CuratorAPIv1{CuratorId: "id", ArtifactKinds: []string{"gcharts"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if message := validateCurator(&tt.curator); (message == "") != tt.valid {
+				t.Errorf("validateCurator() = %q, want valid %v", message, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMergeCurators(t *testing.T) {
+	chartsRun := CuratorEntity{CuratorId: "id", Role: curatorRole_Curator, ArtifactKinds: []string{artifactKind_GChart}, Sports: []string{"Run"}}
+	metricsBike := CuratorEntity{CuratorId: "id", Role: curatorRole_Curator, ArtifactKinds: []string{artifactKind_UserMetric}, Sports: []string{"Bike"}}
+	chartsRunCase := CuratorEntity{CuratorId: "id", Nickname: "nick", ArtifactKinds: []string{"GChart"}, Sports: []string{"run"}}
+	unscoped := CuratorEntity{CuratorId: "id", Role: curatorRole_Curator}
+	admin := CuratorEntity{CuratorId: "id", Role: curatorRole_Admin, Email: "admin@example.com"}
+
+	tests := []struct {
+		name      string
+		curators  []CuratorEntity
+		ok        bool
+		wantRole  string
+		wantKinds []string
+	}{
+		{"same scope", []CuratorEntity{chartsRun, chartsRunCase}, true, curatorRole_Curator, []string{artifactKind_GChart}},
+		{"different kinds and sports", []CuratorEntity{chartsRun, metricsBike}, false, "", nil},
+		{"scoped and unscoped", []CuratorEntity{chartsRun, unscoped}, false, "", nil},
+		{"legacy without role", []CuratorEntity{{CuratorId: "id"}, unscoped}, true, curatorRole_Curator, nil},
+		{"admin wins", []CuratorEntity{chartsRun, metricsBike, admin}, true, curatorRole_Admin, []string{artifactKind_GChart}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, ok := mergeCurators(tt.curators)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if merged.Role != tt.wantRole {
+				t.Errorf("role = %q, want %q", merged.Role, tt.wantRole)
+			}
+			if !sameScope(merged.ArtifactKinds, tt.wantKinds) {
+				t.Errorf("kinds = %v, want %v", merged.ArtifactKinds, tt.wantKinds)
+			}
+		})
+	}
+
+	// the first curator is kept - empty attributes are taken from the others
+	merged, _ := mergeCurators([]CuratorEntity{chartsRun, chartsRunCase})
+	if merged.Nickname != "nick" || merged.Sports[0] != "Run" {
+		t.Errorf("merged = %+v, want the first curator with the nickname of the second", merged)
+	}
+}
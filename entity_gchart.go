@@ -19,9 +19,8 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -44,10 +43,18 @@ type GChartEntity struct {
 	ChartSport   string       `datastore:",noindex"`
 	ChartType    string       `datastore:",noindex"`
 	ChartView    string       `datastore:",noindex"`
-	ChartDef     string       `datastore:",noindex"`
-	Image        []byte       `datastore:",noindex"`
+	ChartDef     string       `datastore:",noindex"` // only if TextEncoding is plain
+	ChartDefGz   []byte       `datastore:",noindex"` // only if TextEncoding is gzip
+	TextEncoding int          `datastore:",noindex"`
+	ContentHash  string       // hash of the normalized ChartDef
+	Image        []byte       `datastore:",noindex"` // only for charts not yet migrated to the blob store
+	ImageType    string       `datastore:",noindex"`
+	Thumbnail    []byte       `datastore:",noindex"` // only for charts not yet migrated to the blob store
+	ImageRef     string       `datastore:",noindex"` // name of the image in the blob store
+	ThumbnailRef string       `datastore:",noindex"` // name of the thumbnail in the blob store
 	CreatorNick  string       `datastore:",noindex"`
-	CreatorEmail string       `datastore:",noindex"`
+	CreatorEmail string       `datastore:",noindex"` // only for artifacts stored before the creator profiles
+	Curation     CommonEntityCuration
 	Internal     GChartEntityInternal
 }
 
@@ -56,6 +63,7 @@ type GChartEntityHeaderOnly struct {
 	ChartSport string
 	ChartType  string
 	ChartView  string
+	Curation   CommonEntityCuration
 }
 
 // Internal attributes which must not be filled by POST or PUT (but are returned on GET)
@@ -76,9 +84,12 @@ type GChartGetAPIv1 struct {
 	ChartView    string      `json:"chartView"`
 	ChartDef     string      `json:"chartDef"`
 	Image        string      `json:"image"`
+	ImageType    string      `json:"imageType"`
+	Thumbnail    string      `json:"thumbnail,omitempty"`
 	CreatorNick  string      `json:"creatorNick"`
 	CreatorEmail string      `json:"creatorEmail"`
 	DLCounter    int         `json:"downloadCount"`
+	Curation     CurationAPIv1 `json:"curation"`
 }
 
 // Reduced structure for POST and PUT (without internal fields)
@@ -105,6 +116,22 @@ type GChartAPIv1HeaderOnly struct {
 }
 type GChartAPIv1HeaderOnlyList []GChartAPIv1HeaderOnly
 
+// headers returns the common headers of the listing (e.g. to add the rating aggregates)
+func (list GChartAPIv1HeaderOnlyList) headers() []*CommonAPIHeaderV1 {
+	headers := make([]*CommonAPIHeaderV1, len(list))
+	for i := range list {
+		headers[i] = &list[i].Header
+	}
+	return headers
+}
+
+// Result of one image migration call
+type GChartImageMigrationAPIv1 struct {
+	Processed int    `json:"processed"`
+	Migrated  int    `json:"migrated"`
+	Cursor    string `json:"cursor"` // empty if all charts are processed
+}
+
 
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -114,38 +141,71 @@ type GChartAPIv1HeaderOnlyList []GChartAPIv1HeaderOnly
 const gChartDBEntity = "gchartentity"
 const gChartDBEntityRootKey = "gchartsroot"
 
-func mapAPItoDBGChart(api *GChartPostAPIv1, db *GChartEntity) {
+// values of the "image" query parameter on GET
+const (
+	gchartImage_Full      = "full"
+	gchartImage_Thumbnail = "thumbnail"
+	gchartImage_None      = "none"
+)
+
+// mapAPItoDBGChart returns an *imageRejectedError if the image can not be accepted
+func mapAPItoDBGChart(api *GChartPostAPIv1, db *GChartEntity) error {
 	mapAPItoDBCommonHeader(&api.Header, &db.Header)
 	db.ChartSport = api.ChartSport
 	db.ChartType = api.ChartType
 	db.ChartView = api.ChartView
-	db.ChartDef = api.ChartDef
+	db.ContentHash = contentHash(api.ChartDef)
+	chartDef, err := compressText(api.ChartDef)
+	if err != nil {
+		return err
+	}
+	db.ChartDef = ""
+	db.ChartDefGz = chartDef
+	db.TextEncoding = textEncoding_Gzip
+	// nickname (fallback) and email are taken from the creator profile on GET - see resolveCreator()
+	db.CreatorNick = api.CreatorNick
+	db.CreatorEmail = ""
+	db.Image = nil
+	db.ImageType = ""
+	db.Thumbnail = nil
+	if api.Image == "" {
+		return nil
+	}
 	data, err := b64.StdEncoding.DecodeString(api.Image)
 	if err != nil {
-		data = nil
-	} else {
-		db.Image = data
+		return &imageRejectedError{http.StatusBadRequest, "Image is not valid base64", err}
 	}
-	// no picture bigger than 1000k please since Appengine
-	// datastore api V3 only supports calls up to 1536 KB
-	if binary.Size(db.Image) > 1024000 {
-		db.Image = nil
+	imageType, err := validateImage(data)
+	if err != nil {
+		return err
 	}
-	db.CreatorNick = api.CreatorNick
-	db.CreatorEmail = api.CreatorEmail
+	db.Image = data
+	db.ImageType = imageType
+	// a missing thumbnail is not a reason to reject the chart
+	db.Thumbnail, _ = createThumbnail(data)
+	return nil
 }
 
 
-func mapDBtoAPIGChart(db *GChartEntity, api *GChartGetAPIv1) {
+func mapDBtoAPIGChart(db *GChartEntity, api *GChartGetAPIv1) error {
 	mapDBtoAPICommonHeader(&db.Header, &api.Header)
 	api.ChartSport = db.ChartSport
 	api.ChartType = db.ChartType
 	api.ChartView = db.ChartView
-	api.ChartDef = db.ChartDef
+	chartDef, err := decodeText(db.TextEncoding, db.ChartDef, db.ChartDefGz)
+	if err != nil {
+		return err
+	}
+	api.ChartDef = chartDef
 	api.Image = b64.StdEncoding.EncodeToString(db.Image)
+	if db.ImageType != "" || len(db.Image) > 0 {
+		api.ImageType = imageContentType(db.ImageType, db.Image)
+	}
 	api.CreatorNick = db.CreatorNick
 	api.CreatorEmail = db.CreatorEmail
 	api.DLCounter = db.Internal.DLCounter
+	mapDBtoAPICuration(&db.Header, &db.Curation, &api.Curation)
+	return nil
 }
 
 
@@ -157,6 +217,18 @@ func gchartEntityRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, gChartDBEntity, gChartDBEntityRootKey, 0, nil)
 }
 
+// clearGChartContent removes everything but the header of a deleted chart
+func clearGChartContent(ctx context.Context, key *datastore.Key, chartDB *GChartEntity) {
+	chartDB.ChartType = ""
+	chartDB.ChartView = ""
+	chartDB.ChartDef = ""
+	chartDB.ChartDefGz = nil
+	chartDB.Image = nil
+	chartDB.ImageType = ""
+	chartDB.Thumbnail = nil
+	deleteGChartImages(ctx, key, chartDB)
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // request/response handler
 // ---------------------------------------------------------------------------------------------------------------//
@@ -166,7 +238,7 @@ func insertGChart(request *restful.Request, response *restful.Response) {
 
 	chart := new(GChartPostAPIv1)
 	if err := request.ReadEntity(chart); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
@@ -174,7 +246,10 @@ func insertGChart(request *restful.Request, response *restful.Response) {
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
 	chartDB := new(GChartEntity)
-	mapAPItoDBGChart(chart, chartDB)
+	if err := mapAPItoDBGChart(chart, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
 
 	// complete/set POST fields
 	chartDB.Header.LastChanged = time.Now()
@@ -182,23 +257,35 @@ func insertGChart(request *restful.Request, response *restful.Response) {
 	chartDB.Header.Deleted = false
 	chartDB.Internal.DLCounter = 0
 
+	// exact duplicates of existing charts are rejected or flagged
+	if !checkDuplicate(ctx, request, response, gChartDBEntity, chartDB.ContentHash) {
+		return
+	}
+
 	// auto-curate if a registered "curator" is adding a gchart
-	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", chartDB.Header.CreatorId)
-	counter, _ := curatorQuery.Count(ctx) // ignore errors/just leave uncurated
-	if counter == 1 {
-		chartDB.Header.Curated = true
-	} else {
-		chartDB.Header.Curated = false
+	chartDB.Header.Curated = isCurator(ctx, chartDB.Header.CreatorId, artifactKind_GChart, chartDB.ChartSport)
+	initCuration(&chartDB.Header, &chartDB.Curation)
+
+	// the id is needed upfront to store the image in the blob store
+	id, _, err := datastore.AllocateIDs(ctx, gChartDBEntity, gchartEntityRootKey(ctx), 1)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	key := datastore.NewKey(ctx, gChartDBEntity, "", id, gchartEntityRootKey(ctx))
+	if err := storeGChartImages(ctx, key, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
 	}
 
 	// and now store it
-	key := datastore.NewIncompleteKey(ctx, gChartDBEntity, gchartEntityRootKey(ctx))
-	key, err := datastore.Put(ctx, key, chartDB);
-	if err != nil {
-		commonResponseErrorProcessing (response, err)
+	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
+	ensureCreator(ctx, chartDB.Header.CreatorId, chart.CreatorNick, chart.CreatorEmail, request.HeaderParameter(creatorSecretHeader))
+
 	// send back the key
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
 
@@ -209,12 +296,12 @@ func updateGChart(request *restful.Request, response *restful.Response) {
 
 	chart := new(GChartPostAPIv1)
 	if err := request.ReadEntity(chart); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
 	if chart.Header.Id == 0 {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Id for Update is missing or invalid")
+		addInvalidRequestError(response, "Mandatory Id for Update is missing or invalid", nil)
 		return
 	}
 
@@ -232,17 +319,29 @@ func updateGChart(request *restful.Request, response *restful.Response) {
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
 	chartDB := new(GChartEntity)
-	mapAPItoDBGChart(chart, chartDB)
+	if err := mapAPItoDBGChart(chart, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
 	chartDB.Internal.DLCounter = currentChartDB.Internal.DLCounter
+	chartDB.Curation = currentChartDB.Curation
+	preserveCommonHeader(&currentChartDB.Header, &chartDB.Header)
 	chartDB.Header.LastChanged = time.Now()
 
+	if err := storeGChartImages(ctx, key, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
 	// and now store it
 
 	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
+	ensureCreator(ctx, chartDB.Header.CreatorId, chart.CreatorNick, chart.CreatorEmail, request.HeaderParameter(creatorSecretHeader))
+
 	// Response is Empty for 204
 	response.WriteHeaderAndEntity(http.StatusNoContent, "")
 
@@ -256,7 +355,7 @@ func getGChartHeader(request *restful.Request, response *restful.Response) {
 	if dateString = request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid dateFrom - correct format is RFC3339", err)
 			return
 		}
 	} else {
@@ -272,14 +371,14 @@ func getGChartHeader(request *restful.Request, response *restful.Response) {
 	var chartsOnDBList []GChartEntityHeaderOnly
 	k, err := q.GetAll(ctx, &chartsOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
 	// DB Entity needs to be mapped back
 	for i, chartDB := range chartsOnDBList {
 		var chart GChartAPIv1HeaderOnly
-		mapDBtoAPICommonHeader(&chartDB.Header, &chart.Header)
+		mapDBtoAPICommonHeaderForListing(&chartDB.Header, &chart.Header)
 		chart.Header.Id = k[i].IntID()
 		chart.ChartSport = chartDB.ChartSport
 		chart.ChartView = chartDB.ChartView
@@ -290,10 +389,58 @@ func getGChartHeader(request *restful.Request, response *restful.Response) {
 	// write Info Log
 	log.Infof(ctx, "GetHeader from: %s", dateString )
 
+	addRatingAggregates(ctx, artifactKind_GChart, chartHeaderList.headers())
+
 	response.WriteHeaderAndEntity(http.StatusOK, chartHeaderList)
 
 }
 
+func getGChartDuplicates(request *restful.Request, response *restful.Response) {
+
+	getDuplicates(request, response, artifactKind_GChart, gChartDBEntity)
+
+}
+
+// getGChartHeaderByCreator lists all charts of a creator - newest first
+func getGChartHeaderByCreator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	q := datastore.NewQuery(gChartDBEntity).Filter("Header.CreatorId =", request.PathParameter("creatorId"))
+
+	var chartsOnDBList []GChartEntityHeaderOnly
+	k, err := q.GetAll(ctx, &chartsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	includeDeleted := includeDeletedForOwner(ctx, request)
+
+	// DB Entity needs to be mapped back
+	chartHeaderList := GChartAPIv1HeaderOnlyList{}
+	for i, chartDB := range chartsOnDBList {
+		if !includeDeleted && (chartDB.Header.Deleted || chartDB.Header.Hidden) {
+			continue
+		}
+		var chart GChartAPIv1HeaderOnly
+		mapDBtoAPICommonHeader(&chartDB.Header, &chart.Header)
+		chart.Header.Id = k[i].IntID()
+		chart.ChartSport = chartDB.ChartSport
+		chart.ChartView = chartDB.ChartView
+		chart.ChartType = chartDB.ChartType
+		chartHeaderList = append(chartHeaderList, chart)
+	}
+
+	// sorted here to avoid a composite index
+	sort.Slice(chartHeaderList, func(i, j int) bool {
+		return chartHeaderList[i].Header.LastChanged > chartHeaderList[j].Header.LastChanged
+	})
+
+	addRatingAggregates(ctx, artifactKind_GChart, chartHeaderList.headers())
+
+	response.WriteHeaderAndEntity(http.StatusOK, chartHeaderList)
+}
+
 func getGChartHeaderCount(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
@@ -302,7 +449,7 @@ func getGChartHeaderCount(request *restful.Request, response *restful.Response)
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid dateFrom - correct format is RFC3339", err)
 			return
 		}
 	} else {
@@ -322,7 +469,19 @@ func getGChartById(request *restful.Request, response *restful.Response) {
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	// the full image is returned by default (GoldenCheetah), but can be
+	// replaced by the thumbnail or left out completely
+	imageParam := request.QueryParameter("image")
+	switch imageParam {
+	case "":
+		imageParam = gchartImage_Full
+	case gchartImage_Full, gchartImage_Thumbnail, gchartImage_None:
+	default:
+		addInvalidRequestError(response, "Invalid image - must be 'full', 'thumbnail' or 'none'", nil)
 		return
 	}
 
@@ -331,18 +490,104 @@ func getGChartById(request *restful.Request, response *restful.Response) {
 	chartDB := new(GChartEntity)
 	err = datastore.Get(ctx, key, chartDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	err = loadGChartImages(ctx, chartDB, imageParam == gchartImage_Full, imageParam == gchartImage_Thumbnail)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
 	// now map and respond
 	chart := new(GChartGetAPIv1)
-	mapDBtoAPIGChart(chartDB, chart)
+	if err := mapDBtoAPIGChart(chartDB, chart); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
 	chart.Header.Id = key.IntID()
+	addRatingAggregates(ctx, artifactKind_GChart, []*CommonAPIHeaderV1{&chart.Header})
+	resolveCreator(ctx, chartDB.Header.CreatorId, &chart.CreatorNick, &chart.CreatorEmail)
+	// the email is personal data - only available to the creator, admins and curators
+	if !canSeeCreatorEmail(ctx, request, chartDB.Header.CreatorId, artifactKind_GChart, chartDB.ChartSport) {
+		chart.CreatorEmail = ""
+	}
+
+	switch imageParam {
+	case gchartImage_Thumbnail:
+		chart.Image = ""
+		if thumbnail := gchartThumbnail(chartDB); thumbnail != nil {
+			chart.Thumbnail = b64.StdEncoding.EncodeToString(thumbnail)
+		}
+	case gchartImage_None:
+		chart.Image = ""
+	}
 
 	response.WriteHeaderAndEntity(http.StatusOK, chart)
 }
 
+func getGChartImageById(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	thumbnail := false
+	if thumbnailString := request.QueryParameter("thumbnail"); thumbnailString != "" {
+		if thumbnail, err = strconv.ParseBool(thumbnailString); err != nil {
+			addInvalidRequestError(response, "Invalid thumbnail - must be 'true' or 'false'", err)
+			return
+		}
+	}
+
+	key := datastore.NewKey(ctx, gChartDBEntity, "", i, gchartEntityRootKey(ctx))
+
+	chartDB := new(GChartEntity)
+	err = datastore.Get(ctx, key, chartDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	if err := loadGChartImages(ctx, chartDB, !thumbnail, thumbnail); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	var data []byte
+	var contentType string
+	if thumbnail {
+		data = gchartThumbnail(chartDB)
+		contentType = imageType_PNG
+	} else {
+		data = chartDB.Image
+		contentType = imageContentType(chartDB.ImageType, data)
+	}
+	if len(data) == 0 {
+		addErrorResponse(response, http.StatusNotFound, errorCode_NotFound, "Chart has no image", "")
+		return
+	}
+
+	// images only change with an update of the chart - so let the client cache them
+	etag := imageETag(data)
+	response.AddHeader("ETag", etag)
+	response.AddHeader("Cache-Control", "private, max-age=86400")
+	response.AddHeader("Last-Modified", chartDB.Header.LastChanged.UTC().Format(http.TimeFormat))
+	if request.HeaderParameter("If-None-Match") == etag {
+		response.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	response.AddHeader("Content-Type", contentType)
+	response.WriteHeader(http.StatusOK)
+	response.Write(data)
+}
+
 func deleteGChartById(request *restful.Request, response *restful.Response) {
 
 	changeGChartById(request, response, true, false, true)
@@ -356,7 +601,7 @@ func incrementGChartUsageById(request *restful.Request, response *restful.Respon
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		addInvalidRequestError(response, "Invalid id", err)
 		return
 	}
 
@@ -365,7 +610,7 @@ func incrementGChartUsageById(request *restful.Request, response *restful.Respon
 	chartDB := new(GChartEntity)
 	err = datastore.Get(ctx, key, chartDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -382,22 +627,256 @@ func curateGChartById(request *restful.Request, response *restful.Response) {
 	newStatusString := request.QueryParameter("newStatus")
 	b, err := strconv.ParseBool(newStatusString)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		addInvalidRequestError(response, "Invalid newStatus - must be 'true' or 'false'", err)
 		return
 	}
 	changeGChartById(request, response, false, true, b)
 
 }
 
+func reviewGChartById(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	review, ok := readCurationReview(request, response)
+	if !ok {
+		return
+	}
+
+	key := datastore.NewKey(ctx, gChartDBEntity, "", i, gchartEntityRootKey(ctx))
+
+	chartDB := new(GChartEntity)
+	err = datastore.Get(ctx, key, chartDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	if !checkCurationPermission(ctx, response, review.CuratorId, artifactKind_GChart, chartDB.ChartSport) {
+		return
+	}
+
+	applyCurationReview(review, &chartDB.Header, &chartDB.Curation)
+
+	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getGChartCurationById(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	key := datastore.NewKey(ctx, gChartDBEntity, "", i, gchartEntityRootKey(ctx))
+
+	chartDB := new(GChartEntityHeaderOnly)
+	err = datastore.Get(ctx, key, chartDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	var curation CurationAPIv1
+	mapDBtoAPICuration(&chartDB.Header, &chartDB.Curation, &curation)
+	curation.Id = key.IntID()
+
+	response.WriteHeaderAndEntity(http.StatusOK, curation)
+}
+
+// getGChartCurationQueue returns the headers of all gcharts waiting for review - oldest first
+func getGChartCurationQueue(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	q := datastore.NewQuery(gChartDBEntity).Filter("Header.Curated =", false).Filter("Header.Deleted =", false)
+
+	var chartsOnDBList []GChartEntityHeaderOnly
+	k, err := q.GetAll(ctx, &chartsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back - rejected charts are not in the queue
+	chartHeaderList := GChartAPIv1HeaderOnlyList{}
+	for i, chartDB := range chartsOnDBList {
+		if curationState(&chartDB.Header, &chartDB.Curation) != curationState_Pending {
+			continue
+		}
+		var chart GChartAPIv1HeaderOnly
+		mapDBtoAPICommonHeader(&chartDB.Header, &chart.Header)
+		chart.Header.Id = k[i].IntID()
+		chart.ChartSport = chartDB.ChartSport
+		chart.ChartView = chartDB.ChartView
+		chart.ChartType = chartDB.ChartType
+		chartHeaderList = append(chartHeaderList, chart)
+	}
+	sort.Slice(chartHeaderList, func(i, j int) bool {
+		return chartHeaderList[i].Header.LastChanged < chartHeaderList[j].Header.LastChanged
+	})
+
+	addRatingAggregates(ctx, artifactKind_GChart, chartHeaderList.headers())
+
+	response.WriteHeaderAndEntity(http.StatusOK, chartHeaderList)
+}
+
+// migrateGChartImages moves inline images of existing charts to the blob store - since the
+// entities are large, only a bucket of charts is processed per call (continue with "cursor")
+func migrateGChartImages(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const maxNumberOfChartsPerCall = 20
+
+	q := datastore.NewQuery(gChartDBEntity).Ancestor(gchartEntityRootKey(ctx))
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var result GChartImageMigrationAPIv1
+	t := q.Run(ctx)
+	for result.Processed < maxNumberOfChartsPerCall {
+		chartDB := new(GChartEntity)
+		key, err := t.Next(chartDB)
+		if err == datastore.Done {
+			// all charts processed
+			response.WriteHeaderAndEntity(http.StatusOK, result)
+			return
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Processed++
+
+		if len(chartDB.Image) == 0 || chartDB.ImageRef != "" {
+			continue
+		}
+		chartDB.ImageType = imageContentType(chartDB.ImageType, chartDB.Image)
+		if chartDB.Thumbnail == nil {
+			chartDB.Thumbnail, _ = createThumbnail(chartDB.Image)
+		}
+		if err := storeGChartImages(ctx, key, chartDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Migrated++
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	result.Cursor = cursor.String()
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+// migrateGChartContentHashes stores the content hash of charts stored before it was introduced -
+// only a bucket of charts is processed per call (continue with "cursor")
+func migrateGChartContentHashes(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const maxNumberOfChartsPerCall = 50
+
+	q := datastore.NewQuery(gChartDBEntity).Ancestor(gchartEntityRootKey(ctx))
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var result ContentHashMigrationAPIv1
+	t := q.Run(ctx)
+	for result.Processed < maxNumberOfChartsPerCall {
+		chartDB := new(GChartEntity)
+		key, err := t.Next(chartDB)
+		if err == datastore.Done {
+			// all charts processed
+			response.WriteHeaderAndEntity(http.StatusOK, result)
+			return
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Processed++
+
+		if chartDB.ContentHash != "" || chartDB.Header.Deleted {
+			continue
+		}
+		chartDef, err := decodeText(chartDB.TextEncoding, chartDB.ChartDef, chartDB.ChartDefGz)
+		if err != nil {
+			log.Warningf(ctx, "Chart %d not readable - no content hash: %v", key.IntID(), err)
+			continue
+		}
+		chartDB.ContentHash = contentHash(chartDef)
+		if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Migrated++
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	result.Cursor = cursor.String()
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
 // ------------------- supporting functions ------------------------------------------------
 
+// gchartThumbnail returns the stored thumbnail - charts stored before thumbnails
+// were introduced get one created on the fly
+func gchartThumbnail(chartDB *GChartEntity) []byte {
+	if chartDB.Thumbnail != nil || len(chartDB.Image) == 0 {
+		return chartDB.Thumbnail
+	}
+	thumbnail, err := createThumbnail(chartDB.Image)
+	if err != nil {
+		return nil
+	}
+	return thumbnail
+}
+
 func changeGChartById(request *restful.Request, response *restful.Response, changeDeleted bool, changeCurated bool, newStatus bool) {
 	ctx := appengine.NewContext(request.Request)
 
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addInvalidRequestError(response, "Invalid id", err)
 		return
 	}
 
@@ -406,7 +885,7 @@ func changeGChartById(request *restful.Request, response *restful.Response, chan
 	chartDB := new(GChartEntity)
 	err = datastore.Get(ctx, key, chartDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -415,26 +894,23 @@ func changeGChartById(request *restful.Request, response *restful.Response, chan
 	if changeDeleted {
 		chartDB.Header.Deleted = newStatus
 		if newStatus {
-			chartDB.ChartType = ""
-			chartDB.ChartView = ""
-			chartDB.ChartDef = ""
-			chartDB.Image = nil
+			clearGChartContent(ctx, key, chartDB)
 		}
 		chartDB.Header.LastChanged = time.Now()
 	}
 
 	if changeCurated {
-		chartDB.Header.Curated = newStatus
+		// the curator must be allowed to curate the artifact kind (and sport)
+		curatorId := request.QueryParameter("curatorId")
+		if !checkCurationPermission(ctx, response, curatorId, artifactKind_GChart, chartDB.ChartSport) {
+			return
+		}
+		setCuration(&chartDB.Header, &chartDB.Curation, newStatus, curatorId)
 		chartDB.Header.LastChanged = time.Now()
 	}
 
 	if _, err := datastore.Put(ctx, key, chartDB); err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Star rating of a user for a gchart/usermetric (ratingentity) which is stored in DB - every rating is
+// its own entity group, so ratings don't contend with each other or with the uploads
+// ---------------------------------------------------------------------------------------------------------------//
+type RatingEntity struct {
+	ArtifactKind string
+	ArtifactId   int64
+	CreatorId    string
+	Stars        int
+	LastChanged  time.Time
+}
+
+const (
+	ratingMinStars = 1
+	ratingMaxStars = 5
+)
+
+// Aggregate of the ratings of an artifact (ratingcounterentity) - sharded, a rating changes
+// one random shard, the aggregate is the sum of all shards
+type RatingCounterEntity struct {
+	Sum   int `datastore:",noindex"`
+	Count int `datastore:",noindex"`
+}
+
+const ratingCounterShards = 4
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Structure for PUT
+type RatingPutAPIv1 struct {
+	CreatorId string `json:"creatorId"`
+	Stars     int    `json:"stars"`
+}
+
+// Aggregated rating (and the own rating if requested)
+type RatingGetAPIv1 struct {
+	ArtifactKind string  `json:"artifactKind"`
+	ArtifactId   int64   `json:"artifactId"`
+	Average      float64 `json:"average"`
+	Count        int     `json:"count"`
+	OwnStars     int     `json:"ownStars,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const ratingDBEntity = "ratingentity"
+const ratingCounterDBEntity = "ratingcounterentity"
+
+// supporting functions
+
+func ratingKeyName(kind string, id int64, creatorId string) string {
+	return fmt.Sprintf("%s-%d-%s", kind, id, creatorId)
+}
+
+// ratingEntityKey is unique per user and artifact - a user has one (updatable) rating
+func ratingEntityKey(ctx context.Context, kind string, id int64, creatorId string) *datastore.Key {
+	return datastore.NewKey(ctx, ratingDBEntity, ratingKeyName(kind, id, creatorId), 0, nil)
+}
+
+func ratingCounterKey(ctx context.Context, kind string, id int64, shard int) *datastore.Key {
+	return datastore.NewKey(ctx, ratingCounterDBEntity, fmt.Sprintf("%s-%d-%d", kind, id, shard), 0, nil)
+}
+
+// loadRating returns the rating of the user (or nil)
+func loadRating(ctx context.Context, kind string, id int64, creatorId string) (*RatingEntity, error) {
+	ratingDB := new(RatingEntity)
+	err := datastore.Get(ctx, ratingEntityKey(ctx, kind, id, creatorId), ratingDB)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	return ratingDB, nil
+}
+
+// changeRatingCounter adds the change to one random shard of the artifact's counter
+func changeRatingCounter(tc context.Context, kind string, id int64, sum int, count int) error {
+	key := ratingCounterKey(tc, kind, id, rand.Intn(ratingCounterShards))
+	counterDB := new(RatingCounterEntity)
+	if err := datastore.Get(tc, key, counterDB); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	counterDB.Sum += sum
+	counterDB.Count += count
+	_, err := datastore.Put(tc, key, counterDB)
+	return err
+}
+
+// deleteRating removes the rating and its share of the aggregate
+func deleteRating(ctx context.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		ratingDB := new(RatingEntity)
+		if err := datastore.Get(tc, key, ratingDB); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			if !isErrFieldMismatch(err) {
+				return err
+			}
+		}
+		if err := datastore.Delete(tc, key); err != nil {
+			return err
+		}
+		return changeRatingCounter(tc, ratingDB.ArtifactKind, ratingDB.ArtifactId, -ratingDB.Stars, -1)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// addRatingAggregates sets the aggregates of the headers from the sharded counters - on errors
+// the headers are left without aggregates
+func addRatingAggregates(ctx context.Context, kind string, headers []*CommonAPIHeaderV1) {
+	// GetMulti is limited to 1000 keys
+	const maxHeadersPerCall = 1000 / ratingCounterShards
+
+	for len(headers) > 0 {
+		n := len(headers)
+		if n > maxHeadersPerCall {
+			n = maxHeadersPerCall
+		}
+		if err := addRatingCounters(ctx, kind, headers[:n]); err != nil {
+			log.Warningf(ctx, "Reading rating counters failed: %v", err)
+			return
+		}
+		headers = headers[n:]
+	}
+}
+
+func addRatingCounters(ctx context.Context, kind string, headers []*CommonAPIHeaderV1) error {
+	keys := make([]*datastore.Key, 0, len(headers)*ratingCounterShards)
+	for _, header := range headers {
+		for shard := 0; shard < ratingCounterShards; shard++ {
+			keys = append(keys, ratingCounterKey(ctx, kind, header.Id, shard))
+		}
+	}
+	counters := make([]RatingCounterEntity, len(keys))
+	if err := datastore.GetMulti(ctx, keys, counters); err != nil {
+		errs, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for _, e := range errs {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return e
+			}
+		}
+	}
+
+	for i, header := range headers {
+		sum := 0
+		header.RatingCount = 0
+		for _, counterDB := range counters[i*ratingCounterShards : (i+1)*ratingCounterShards] {
+			sum += counterDB.Sum
+			header.RatingCount += counterDB.Count
+		}
+		header.RatingAverage = 0
+		if header.RatingCount > 0 {
+			header.RatingAverage = float64(sum) / float64(header.RatingCount)
+		}
+	}
+	return nil
+}
+
+// readArtifactPath returns kind and id of the artifact from the path, false is returned if the
+// request is already answered
+func readArtifactPath(request *restful.Request, response *restful.Response) (string, int64, bool) {
+	kind := request.PathParameter("artifactKind")
+	if !isArtifactKind(kind) {
+		addInvalidRequestError(response, "Invalid artifactKind - must be 'gchart' or 'usermetric'", nil)
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(request.PathParameter("artifactId"), 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid artifactId", err)
+		return "", 0, false
+	}
+	return kind, id, true
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func upsertRating(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	kind, id, ok := readArtifactPath(request, response)
+	if !ok {
+		return
+	}
+
+	rating := new(RatingPutAPIv1)
+	if err := request.ReadEntity(rating); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+	if rating.CreatorId == "" {
+		addInvalidRequestError(response, "Mandatory creatorId is missing", nil)
+		return
+	}
+	if rating.Stars < ratingMinStars || rating.Stars > ratingMaxStars {
+		addInvalidRequestError(response, fmt.Sprintf("Invalid stars - must be between %d and %d", ratingMinStars, ratingMaxStars), nil)
+		return
+	}
+
+	// the artifact must exist
+	if _, _, _, _, err := loadArtifact(ctx, kind, id); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// rating and counter are changed together (different entity groups)
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		ratingDB, err := loadRating(tc, kind, id, rating.CreatorId)
+		if err != nil {
+			return err
+		}
+		sum, count := rating.Stars, 1
+		if ratingDB != nil {
+			// update of an existing rating
+			sum, count = rating.Stars-ratingDB.Stars, 0
+		} else {
+			ratingDB = new(RatingEntity)
+		}
+
+		key := ratingEntityKey(tc, kind, id, rating.CreatorId)
+		ratingDB.ArtifactKind = kind
+		ratingDB.ArtifactId = id
+		ratingDB.CreatorId = rating.CreatorId
+		ratingDB.Stars = rating.Stars
+		ratingDB.LastChanged = time.Now()
+		if _, err := datastore.Put(tc, key, ratingDB); err != nil {
+			return err
+		}
+		return changeRatingCounter(tc, kind, id, sum, count)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getRating(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	kind, id, ok := readArtifactPath(request, response)
+	if !ok {
+		return
+	}
+
+	// the artifact must exist
+	if _, _, _, _, err := loadArtifact(ctx, kind, id); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	header := CommonAPIHeaderV1{Id: id}
+	addRatingAggregates(ctx, kind, []*CommonAPIHeaderV1{&header})
+
+	var ratingAPI RatingGetAPIv1
+	ratingAPI.ArtifactKind = kind
+	ratingAPI.ArtifactId = id
+	ratingAPI.Count = header.RatingCount
+	ratingAPI.Average = header.RatingAverage
+
+	if creatorId := request.QueryParameter("creatorId"); creatorId != "" {
+		ratingDB, err := loadRating(ctx, kind, id, creatorId)
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		if ratingDB != nil {
+			ratingAPI.OwnStars = ratingDB.Stars
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, ratingAPI)
+}
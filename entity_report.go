@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Abuse report of a shared artifact (reportentity) which is stored in DB
+// ---------------------------------------------------------------------------------------------------------------//
+type ReportEntity struct {
+	ArtifactKind string
+	ArtifactId   int64
+	ReporterId   string
+	Reason       string `datastore:",noindex"`
+	CreateDate   time.Time
+	Status       string
+	ResolvedBy   string    // indexed for the data export/erasure of the curator (see "privacy.go")
+	ResolveDate  time.Time `datastore:",noindex"`
+	Resolution   string    `datastore:",noindex"`
+}
+
+const (
+	reportStatus_Open     = "open"
+	reportStatus_Resolved = "resolved"
+)
+
+// Curator decisions on reported artifacts
+const (
+	reportResolution_Restore = "restore" // report not justified - show the artifact again
+	reportResolution_Confirm = "confirm" // report justified - artifact stays hidden
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Structure for POST
+type ReportPostAPIv1 struct {
+	ArtifactKind string `json:"artifactKind"`
+	ArtifactId   int64  `json:"artifactId"`
+	ReporterId   string `json:"reporterId"`
+	Reason       string `json:"reason"`
+}
+
+type ReportGetAPIv1 struct {
+	ArtifactKind string `json:"artifactKind"`
+	ArtifactId   int64  `json:"artifactId"`
+	ReporterId   string `json:"reporterId"`
+	Reason       string `json:"reason"`
+	CreateDate   string `json:"createDate"`
+	Status       string `json:"status"`
+	ResolvedBy   string `json:"resolvedBy"`
+	ResolveDate  string `json:"resolveDate"`
+	Resolution   string `json:"resolution"`
+}
+
+type ReportGetAPIv1List []ReportGetAPIv1
+
+// Curator decision on all open reports of an artifact
+type ReportResolveAPIv1 struct {
+	ArtifactKind string `json:"artifactKind"`
+	ArtifactId   int64  `json:"artifactId"`
+	CuratorId    string `json:"curatorId"`
+	Resolution   string `json:"resolution"`
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const reportDBEntity = "reportentity"
+const reportDBEntityRootKey = "reportroot"
+
+// number of distinct reporters after which an artifact is hidden - can be set in app.yaml
+const reportThresholdConfig = "Report_Threshold"
+const reportDefaultThreshold = 3
+
+func mapAPItoDBReport(api *ReportPostAPIv1, db *ReportEntity) {
+	db.ArtifactKind = api.ArtifactKind
+	db.ArtifactId = api.ArtifactId
+	db.ReporterId = api.ReporterId
+	db.Reason = api.Reason
+}
+
+func mapDBtoAPIReport(db *ReportEntity, api *ReportGetAPIv1) {
+	api.ArtifactKind = db.ArtifactKind
+	api.ArtifactId = db.ArtifactId
+	api.ReporterId = db.ReporterId
+	api.Reason = db.Reason
+	api.CreateDate = db.CreateDate.Format(dateTimeLayout)
+	api.Status = db.Status
+	api.ResolvedBy = db.ResolvedBy
+	if !db.ResolveDate.IsZero() {
+		api.ResolveDate = db.ResolveDate.Format(dateTimeLayout)
+	}
+	api.Resolution = db.Resolution
+}
+
+// supporting functions
+
+// reportEntityRootKey returns the key used for all reportEntity entries.
+func reportEntityRootKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, reportDBEntity, reportDBEntityRootKey, 0, nil)
+}
+
+// reportEntityKey is unique per reporter and artifact, so every reporter counts only once
+func reportEntityKey(ctx context.Context, kind string, id int64, reporterId string) *datastore.Key {
+	return datastore.NewKey(ctx, reportDBEntity, fmt.Sprintf("%s-%d-%s", kind, id, reporterId), 0, reportEntityRootKey(ctx))
+}
+
+func reportThreshold() int {
+	if threshold, err := strconv.Atoi(os.Getenv(reportThresholdConfig)); err == nil && threshold > 0 {
+		return threshold
+	}
+	return reportDefaultThreshold
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func insertReport(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	report := new(ReportPostAPIv1)
+	if err := request.ReadEntity(report); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+
+	if !isArtifactKind(report.ArtifactKind) {
+		addInvalidRequestError(response, "Invalid artifactKind - must be 'gchart' or 'usermetric'", nil)
+		return
+	}
+	if report.ArtifactId == 0 || report.ReporterId == "" || report.Reason == "" {
+		addInvalidRequestError(response, "Mandatory artifactId, reporterId or reason is missing", nil)
+		return
+	}
+
+	// the artifact must exist
+	if _, _, _, _, err := loadArtifact(ctx, report.ArtifactKind, report.ArtifactId); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// only known creators count as reporters - made up ids must not hide artifacts
+	reporterDB, err := loadCreator(ctx, report.ReporterId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if reporterDB == nil {
+		addErrorResponse(response, http.StatusForbidden, errorCode_Forbidden, "Reporter has no creator profile", report.ReporterId)
+		return
+	}
+
+	reportDB := new(ReportEntity)
+	mapAPItoDBReport(report, reportDB)
+	reportDB.CreateDate = time.Now()
+	reportDB.Status = reportStatus_Open
+
+	// a repeated report of the same reporter replaces the previous one - the report and the
+	// hiding of the artifact are one transaction, so no report can be missed by the count
+	key := reportEntityKey(ctx, report.ArtifactKind, report.ArtifactId, report.ReporterId)
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		artifactKey, artifactDB, header, _, err := loadArtifact(tc, report.ArtifactKind, report.ArtifactId)
+		if err != nil {
+			return err
+		}
+		if _, err := datastore.Put(tc, key, reportDB); err != nil {
+			return err
+		}
+
+		// hide the artifact (pending curator review) once enough distinct users reported it - the
+		// ancestor query is strongly consistent, so the report just stored is counted
+		q := datastore.NewQuery(reportDBEntity).
+			Ancestor(reportEntityRootKey(tc)).
+			Filter("ArtifactKind =", report.ArtifactKind).
+			Filter("ArtifactId =", report.ArtifactId).
+			Filter("Status =", reportStatus_Open)
+		counter, err := q.Count(tc)
+		if err != nil {
+			return err
+		}
+		if counter >= reportThreshold() && !header.Hidden {
+			header.Hidden = true
+			header.LastChanged = time.Now() // so that clients pick up the change
+			if _, err := datastore.Put(tc, artifactKey, artifactDB); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusCreated, key.StringID())
+}
+
+// getReport is the curator listing of reports - open reports by default, oldest first, only
+// the reports of artifacts the curator is allowed to curate, paged with the "X-Cursor" header
+func getReport(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const defaultPageSize = 100
+	const maxPageSize = 1000
+
+	status := request.QueryParameter("status")
+	if status == "" {
+		status = reportStatus_Open
+	}
+	kind := request.QueryParameter("artifactKind")
+	if kind != "" && !isArtifactKind(kind) {
+		addInvalidRequestError(response, "Invalid artifactKind - must be 'gchart' or 'usermetric'", nil)
+		return
+	}
+
+	curatorId := request.QueryParameter("curatorId")
+	if !checkCurationPermission(ctx, response, curatorId, kind, "") {
+		return
+	}
+	curatorOnDBList, err := loadCurators(ctx, curatorId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	pageSize := defaultPageSize
+	if limitString := request.QueryParameter("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			addInvalidRequestError(response, fmt.Sprintf("Invalid limit - must be between 1 and %d", maxPageSize), err)
+			return
+		}
+		pageSize = limit
+	}
+
+	// ordered by the datastore (see index.yaml)
+	q := datastore.NewQuery(reportDBEntity).Ancestor(reportEntityRootKey(ctx)).Filter("Status =", status)
+	if kind != "" {
+		q = q.Filter("ArtifactKind =", kind)
+	}
+	q = q.Order("CreateDate")
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	reportList := ReportGetAPIv1List{}
+	t := q.Limit(pageSize).Run(ctx)
+	read := 0
+	for {
+		var reportDB ReportEntity
+		_, err := t.Next(&reportDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		read++
+
+		// the sport of charts is only known from the chart
+		sport := ""
+		if reportDB.ArtifactKind == artifactKind_GChart {
+			_, _, _, chartSport, err := loadArtifact(ctx, reportDB.ArtifactKind, reportDB.ArtifactId)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			sport = chartSport
+		}
+		if !isAnyScopedTo(curatorOnDBList, reportDB.ArtifactKind, sport) {
+			continue
+		}
+
+		// DB Entity needs to be mapped back
+		var reportAPI ReportGetAPIv1
+		mapDBtoAPIReport(&reportDB, &reportAPI)
+		reportList = append(reportList, reportAPI)
+	}
+
+	// a full page (before the scope filter) may be followed by more reports
+	if read == pageSize {
+		cursor, err := t.Cursor()
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		response.AddHeader(cursorHeader, cursor.String())
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, reportList)
+}
+
+// resolveReport closes all open reports of an artifact and restores the artifact or keeps it hidden
+func resolveReport(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	resolve := new(ReportResolveAPIv1)
+	if err := request.ReadEntity(resolve); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+
+	if !isArtifactKind(resolve.ArtifactKind) {
+		addInvalidRequestError(response, "Invalid artifactKind - must be 'gchart' or 'usermetric'", nil)
+		return
+	}
+	if resolve.Resolution != reportResolution_Restore && resolve.Resolution != reportResolution_Confirm {
+		addInvalidRequestError(response, "Invalid resolution - must be 'restore' or 'confirm'", nil)
+		return
+	}
+
+	artifactKey, artifactDB, header, sport, err := loadArtifact(ctx, resolve.ArtifactKind, resolve.ArtifactId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	if !checkCurationPermission(ctx, response, resolve.CuratorId, resolve.ArtifactKind, sport) {
+		return
+	}
+
+	q := datastore.NewQuery(reportDBEntity).
+		Ancestor(reportEntityRootKey(ctx)).
+		Filter("ArtifactKind =", resolve.ArtifactKind).
+		Filter("ArtifactId =", resolve.ArtifactId).
+		Filter("Status =", reportStatus_Open)
+	var reportOnDBList []ReportEntity
+	keys, err := q.GetAll(ctx, &reportOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	for i := range reportOnDBList {
+		reportOnDBList[i].Status = reportStatus_Resolved
+		reportOnDBList[i].ResolvedBy = resolve.CuratorId
+		reportOnDBList[i].ResolveDate = time.Now()
+		reportOnDBList[i].Resolution = resolve.Resolution
+	}
+	if len(keys) > 0 {
+		if _, err := datastore.PutMulti(ctx, keys, reportOnDBList); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	hidden := resolve.Resolution == reportResolution_Confirm
+	if header.Hidden != hidden {
+		header.Hidden = hidden
+		header.LastChanged = time.Now()
+		if _, err := datastore.Put(ctx, artifactKey, artifactDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
@@ -19,7 +19,6 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -27,7 +26,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 
 	"github.com/emicklei/go-restful"
 )
@@ -36,9 +34,14 @@ import (
 // ---------------------------------------------------------------------------------------------------------------//
 // Golden Cheetah curator (statusentity) which is stored in DB
 // ---------------------------------------------------------------------------------------------------------------//
+// A status is active from ChangeDate (which can be in the future to announce a maintenance
+// window) until EndDate - or until the next status becomes active if there is no EndDate
 type StatusEntity struct {
-	Status     int
-	ChangeDate time.Time
+	Status        int
+	ChangeDate    time.Time
+	EndDate       time.Time `datastore:",noindex"`
+	ArtifactKinds []string  `datastore:",noindex"` // Status_PartialFailure only - empty = all
+	Operations    []string  `datastore:",noindex"` // Status_PartialFailure only - empty = write
 }
 
 // Constants defined for documentation purposes - as they are set by GC
@@ -48,10 +51,17 @@ const (
 	Status_Outage = 30
 )
 
+// Operations affected by a partial failure
+const (
+	statusOperation_Read  = "read"
+	statusOperation_Write = "write"
+)
+
 
 
 type StatusEntityText struct {
-	Text string                 `datastore:",noindex"`
+	Text  string                 `datastore:",noindex"` // English
+	Texts []LocalizedText        // translations
 }
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -63,18 +73,27 @@ type StatusEntityPostAPIv1 struct {
 	Id         int64        `json:"id"`
 	Status     int        `json:"status"`
 	ChangeDate string        `json:"changeDate"`
-	Text       string       `json:"text"`
+	EndDate    string       `json:"endDate"` // optional - end of a (maintenance) window
+	ArtifactKinds []string  `json:"artifactKinds"` // optional - kinds affected by a partial failure
+	Operations []string     `json:"operations"`    // optional - 'read'/'write' affected by a partial failure
+	Text       string       `json:"text"`  // English
+	Texts      map[string]string `json:"texts"` // optional - translations by language (e.g. "de")
 }
 
 type StatusEntityGetAPIv1 struct {
 	Id         int64        `json:"id"`
 	Status     int        `json:"status"`
 	ChangeDate string        `json:"changeDate"`
+	EndDate    string       `json:"endDate,omitempty"`
+	ArtifactKinds []string  `json:"artifactKinds,omitempty"`
+	Operations []string     `json:"operations,omitempty"`
+	Upcoming   []StatusEntityGetAPIv1 `json:"upcoming,omitempty"` // only for the latest status
 }
 
 type StatusEntityGetTextAPIv1 struct {
-	Id   int64        `json:"id"`
-	Text string       `json:"text"`
+	Id       int64        `json:"id"`
+	Language string       `json:"language"` // of the text - best match for Accept-Language
+	Text     string       `json:"text"`
 }
 
 type StatusEntityGetAPIv1List []StatusEntityGetAPIv1
@@ -83,7 +102,7 @@ type StatusEntityGetAPIv1List []StatusEntityGetAPIv1
 // Memcache constants
 // ---------------------------------------------------------------------------------------------------------------//
 
-const statusMemcacheKey = "currentstatus"
+const statusMemcacheKey = "currentstatus.v2" // cachedStatus - older entries have a different encoding
 
 // ---------------------------------------------------------------------------------------------------------------//
 // Data Storage View
@@ -93,19 +112,34 @@ const statusDBEntityRootKey = "statusroot"
 const statusDBEntity = "statusentity"
 const statusDBEntityText = "statusText"
 
-func mapAPItoDBStatus(api *StatusEntityPostAPIv1, db *StatusEntity) {
+// mapAPItoDBStatus returns an error if the endDate is not readable - the status would
+// never end otherwise
+func mapAPItoDBStatus(api *StatusEntityPostAPIv1, db *StatusEntity) error {
 	db.Status = api.Status
 	if api.ChangeDate != "" {
 		db.ChangeDate, _ = time.Parse(dateTimeLayout, api.ChangeDate)
 	} else {
 		db.ChangeDate = time.Now()
 	}
-
+	if api.EndDate != "" {
+		var err error
+		if db.EndDate, err = time.Parse(dateTimeLayout, api.EndDate); err != nil {
+			return err
+		}
+	}
+	db.ArtifactKinds = api.ArtifactKinds
+	db.Operations = api.Operations
+	return nil
 }
 
 func mapDBtoAPIStatus(db *StatusEntity, api *StatusEntityGetAPIv1) {
 	api.Status = db.Status
 	api.ChangeDate = db.ChangeDate.Format(dateTimeLayout)
+	if !db.EndDate.IsZero() {
+		api.EndDate = db.EndDate.Format(dateTimeLayout)
+	}
+	api.ArtifactKinds = db.ArtifactKinds
+	api.Operations = db.Operations
 }
 
 
@@ -116,6 +150,86 @@ func statusEntityRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, statusDBEntity, statusDBEntityRootKey, 0, nil)
 }
 
+// isActiveAt checks if the status window covers the time
+func (statusDB *StatusEntity) isActiveAt(t time.Time) bool {
+	return !statusDB.ChangeDate.After(t) && (statusDB.EndDate.IsZero() || statusDB.EndDate.After(t))
+}
+
+// blocks checks if the status rejects an operation ('read' or 'write') on the artifact kind -
+// a partial failure only affects the given kinds and operations (writes by default), every
+// other status except Status_Ok blocks everything
+func (statusDB *StatusEntity) blocks(kind string, operation string) bool {
+	switch statusDB.Status {
+	case Status_Ok:
+		return false
+	case Status_PartialFailure:
+		operations := statusDB.Operations
+		if len(operations) == 0 {
+			operations = []string{statusOperation_Write}
+		}
+		if !containsFold(operations, operation) {
+			return false
+		}
+		return len(statusDB.ArtifactKinds) == 0 || containsFold(statusDB.ArtifactKinds, kind)
+	}
+	return true
+}
+
+// loadCurrentStatus returns the latest started status which is still active - nil (and no
+// error) if there is none, which means Status_Ok. The returned time is the next point of
+// time where the current status may change (zero if no change is scheduled).
+func loadCurrentStatus(ctx context.Context) (*StatusEntity, *datastore.Key, time.Time, error) {
+	// a window may only hide a few earlier status entries
+	const maxNumberOfStartedStatus = 20
+
+	now := time.Now()
+	var nextChange time.Time
+
+	// the next scheduled status
+	var upcomingOnDBList []StatusEntity
+	// ancestor queries - a status just inserted must be found (see index.yaml)
+	rootKey := statusEntityRootKey(ctx)
+	_, err := datastore.NewQuery(statusDBEntity).Ancestor(rootKey).Filter("ChangeDate >", now).Order("ChangeDate").Limit(1).GetAll(ctx, &upcomingOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, nil, nextChange, err
+	}
+	if len(upcomingOnDBList) > 0 {
+		nextChange = upcomingOnDBList[0].ChangeDate
+	}
+
+	q := datastore.NewQuery(statusDBEntity).Ancestor(rootKey).Filter("ChangeDate <=", now).Order("-ChangeDate").Limit(maxNumberOfStartedStatus)
+	var statusOnDBList []StatusEntity
+	k, err := q.GetAll(ctx, &statusOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, nil, nextChange, err
+	}
+	for i := range statusOnDBList {
+		if statusOnDBList[i].isActiveAt(now) {
+			end := statusOnDBList[i].EndDate
+			if !end.IsZero() && (nextChange.IsZero() || end.Before(nextChange)) {
+				nextChange = end
+			}
+			return &statusOnDBList[i], k[i], nextChange, nil
+		}
+	}
+	return nil, nil, nextChange, nil
+}
+
+// bootstrapStatus stores an initial Status_Ok if there is no status at all, so that a fresh
+// installation has a status history and a status text can be added
+func bootstrapStatus(ctx context.Context) error {
+	rootKey := statusEntityRootKey(ctx)
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		keys, err := datastore.NewQuery(statusDBEntity).Ancestor(rootKey).KeysOnly().Limit(1).GetAll(tc, nil)
+		if err != nil || len(keys) > 0 {
+			return err
+		}
+		statusDB := &StatusEntity{Status: Status_Ok, ChangeDate: time.Now()}
+		_, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, statusDBEntity, rootKey), statusDB)
+		return err
+	}, nil)
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // request/response handler
 // ---------------------------------------------------------------------------------------------------------------//
@@ -125,7 +239,7 @@ func insertStatus(request *restful.Request, response *restful.Response) {
 
 	status := new(StatusEntityPostAPIv1)
 	if err := request.ReadEntity(status); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
@@ -133,34 +247,44 @@ func insertStatus(request *restful.Request, response *restful.Response) {
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
 	statusDB := new(StatusEntity)
-	mapAPItoDBStatus(status, statusDB)
+	if err := mapAPItoDBStatus(status, statusDB); err != nil {
+		addInvalidRequestError(response, "Invalid endDate - correct format is "+dateTimeLayout, err)
+		return
+	}
+	if !statusDB.EndDate.IsZero() && !statusDB.EndDate.After(statusDB.ChangeDate) {
+		addInvalidRequestError(response, "Invalid endDate - must be after changeDate", nil)
+		return
+	}
+	for _, operation := range statusDB.Operations {
+		if operation != statusOperation_Read && operation != statusOperation_Write {
+			addInvalidRequestError(response, "Invalid operations - must be 'read' or 'write'", nil)
+			return
+		}
+	}
+	for _, kind := range statusDB.ArtifactKinds {
+		if !isArtifactKind(kind) {
+			addInvalidRequestError(response, "Invalid artifactKinds - must be 'gchart' or 'usermetric'", nil)
+			return
+		}
+	}
 
 	// and now store it
 	key := datastore.NewIncompleteKey(ctx, statusDBEntity, statusEntityRootKey(ctx))
 	key, err := datastore.Put(ctx, key, statusDB);
 	if err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
-	if status.Text != "" {
+	if status.Text != "" || len(status.Texts) > 0 {
 		statusDBText := new(StatusEntityText)
 		statusDBText.Text = status.Text
+		statusDBText.Texts = mapAPItoDBLocalizedTexts(status.Texts)
 		// and now store it as child of statusEntry
 		key := datastore.NewIncompleteKey(ctx, statusDBEntityText, key)
 		key, err := datastore.Put(ctx, key, statusDBText);
 		if err != nil {
-			if appengine.IsOverQuota(err) {
-				// return 503 and a text similar to what GAE is returning as well
-				addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-			} else {
-				addPlainTextError(response, http.StatusInternalServerError, err.Error())
-			}
+			commonResponseErrorProcessing(response, err)
 			return
 		}
 	}
@@ -170,8 +294,8 @@ func insertStatus(request *restful.Request, response *restful.Response) {
 	in.Status = status.Status
 	in.ChangeDate = status.ChangeDate
 
-	// flush the memcache
-	memcache.Flush(ctx)
+	// only the current status is affected
+	invalidateStatusCache(ctx)
 
 	// send back the key
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
@@ -186,7 +310,7 @@ func getStatus(request *restful.Request, response *restful.Response) {
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid dateFrom - correct format is RFC3339", err)
 			return
 		}
 	} else {
@@ -195,17 +319,12 @@ func getStatus(request *restful.Request, response *restful.Response) {
 
 	q := datastore.NewQuery(statusDBEntity).Filter("ChangeDate >=", date).Order("-ChangeDate")
 
-	var statusList StatusEntityGetAPIv1List
+	statusList := StatusEntityGetAPIv1List{} // an empty list (not null) if there is no status
 
 	var statusOnDBList []StatusEntity
 	k, err := q.GetAll(ctx, &statusOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -223,38 +342,24 @@ func getStatus(request *restful.Request, response *restful.Response) {
 func getCurrentStatus(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
-	var statusAPI StatusEntityGetAPIv1
-
-	// first check Memcache
-	if _, err := memcache.Gob.Get(ctx, statusMemcacheKey, &statusAPI); err == nil {
-		response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
+	status, err := getCurrentStatusCached(ctx)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
-	q := datastore.NewQuery(statusDBEntity).Order("-ChangeDate").Limit(1)
-
-	var statusOnDBList []StatusEntity
-	k, err := q.GetAll(ctx, &statusOnDBList)
-	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
-		return
+	// DB Entity needs to be mapped back - without an active status everything is fine
+	var statusAPI StatusEntityGetAPIv1
+	if status.Id != 0 {
+		mapDBtoAPIStatus(&status.Status, &statusAPI)
+		statusAPI.Id = status.Id
+	} else {
+		statusAPI.Status = Status_Ok
+		statusAPI.ChangeDate = time.Now().Format(dateTimeLayout)
 	}
 
-	// DB Entity needs to be mapped back
-	mapDBtoAPIStatus(&statusOnDBList[0], &statusAPI)
-	statusAPI.Id = k[0].IntID()
-
-	// add to memcache / overwrite existing / ignore errors
-	item := &memcache.Item{
-		Key:   statusMemcacheKey,
-		Object: statusAPI,
-	}
-	memcache.Gob.Set(ctx, item)
+	// announce the scheduled status windows
+	statusAPI.Upcoming = status.Upcoming
 
 	response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
 }
@@ -265,7 +370,7 @@ func getStatusTextById(request *restful.Request, response *restful.Response) {
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addInvalidRequestError(response, "Invalid id", err)
 		return
 	}
 
@@ -276,19 +381,21 @@ func getStatusTextById(request *restful.Request, response *restful.Response) {
 	var statusTextOnDBList []StatusEntityText
 	k, err := q.GetAll(ctx, &statusTextOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// unknown status or a status without text
+	if len(statusTextOnDBList) == 0 {
+		addErrorResponse(response, http.StatusNotFound, errorCode_NotFound, "Status text not found", "")
 		return
 	}
 
 	// DB Entity needs to be mapped back
 	var statusAPI StatusEntityGetTextAPIv1
 	statusAPI.Id = k[0].IntID()
-	statusAPI.Text = statusTextOnDBList[0].Text
+	statusAPI.Language, statusAPI.Text = localizedText(acceptedLanguages(request.HeaderParameter(acceptLanguageHeader)),
+		statusTextOnDBList[0].Text, statusTextOnDBList[0].Texts)
 
 	response.WriteHeaderAndEntity(http.StatusOK, statusAPI)
 
@@ -299,25 +406,17 @@ func getStatusTextById(request *restful.Request, response *restful.Response) {
 //---------------------------------------------------------------------------------------
 
 func internalGetCurrentStatus(ctx context.Context) int {
+	statusDB, _ := internalGetCurrentStatusEntity(ctx)
+	return statusDB.Status
+}
 
-	// first check Memcache
-	if item, err := memcache.Get(ctx, statusMemcacheKey); err == nil {
-		if i64, err := strconv.ParseInt(string(item.Value), 10, 0); err == nil {
-			return int(i64)
-		}
-	}
-
-	q := datastore.NewQuery(statusDBEntity).Order("-ChangeDate").Limit(1)
-
-	var statusOnDBList []StatusEntity
-	_, err := q.GetAll(ctx, &statusOnDBList)
-	if (err != nil && !isErrFieldMismatch(err)) || len(statusOnDBList) == 0 {
+// internalGetCurrentStatusEntity returns the active status (Status_Ok if there is none) and
+// the time when it's expected to end (zero if unknown)
+func internalGetCurrentStatusEntity(ctx context.Context) (*StatusEntity, time.Time) {
+	status, err := getCurrentStatusCached(ctx)
+	if err != nil {
 		// we are not blocking to due problems in Status Management
-		return Status_Ok
+		return &StatusEntity{Status: Status_Ok}, time.Time{}
 	}
-
-	return statusOnDBList[0].Status
+	return &status.Status, status.NextChange
 }
-
-
-
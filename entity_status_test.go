@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+)
+
+func TestMapAPItoDBStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		endDate string
+		want    time.Time
+		error   bool
+	}{
+		{"open ended", "", time.Time{}, false},
+		{"end date", "2020-05-01T10:00:00Z", time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC), false},
+		{"invalid end date", "2020-05-01 10:00", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var statusDB StatusEntity
+			err := mapAPItoDBStatus(&StatusEntityPostAPIv1{Status: Status_Outage, EndDate: tt.endDate}, &statusDB)
+			if (err != nil) != tt.error {
+				t.Fatalf("error = %v, want error %v", err, tt.error)
+			}
+			if !tt.error && !statusDB.EndDate.Equal(tt.want) {
+				t.Errorf("endDate = %v, want %v", statusDB.EndDate, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusIsActiveAt(t *testing.T) {
+	start := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	window := &StatusEntity{ChangeDate: start, EndDate: start.Add(time.Hour)}
+	openEnded := &StatusEntity{ChangeDate: start}
+
+	tests := []struct {
+		name   string
+		status *StatusEntity
+		at     time.Time
+		want   bool
+	}{
+		{"before start", window, start.Add(-time.Second), false},
+		{"at start", window, start, true},
+		{"within", window, start.Add(30 * time.Minute), true},
+		{"at end", window, start.Add(time.Hour), false},
+		{"open ended", openEnded, start.AddDate(1, 0, 0), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.status.isActiveAt(tt.at); got != tt.want {
+				t.Errorf("isActiveAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusBlocks(t *testing.T) {
+	ok := &StatusEntity{Status: Status_Ok}
+	outage := &StatusEntity{Status: Status_Outage}
+	partial := &StatusEntity{Status: Status_PartialFailure}
+	partialReads := &StatusEntity{Status: Status_PartialFailure, Operations: []string{statusOperation_Read}}
+	partialCharts := &StatusEntity{Status: Status_PartialFailure, ArtifactKinds: []string{artifactKind_GChart}}
+	partialAll := &StatusEntity{Status: Status_PartialFailure,
+		Operations: []string{statusOperation_Read, statusOperation_Write}, ArtifactKinds: []string{artifactKind_UserMetric}}
+
+	tests := []struct {
+		name      string
+		status    *StatusEntity
+		kind      string
+		operation string
+		want      bool
+	}{
+		{"ok read", ok, artifactKind_GChart, statusOperation_Read, false},
+		{"ok write", ok, artifactKind_GChart, statusOperation_Write, false},
+		{"outage read", outage, artifactKind_GChart, statusOperation_Read, true},
+		{"outage other", outage, "version", statusOperation_Read, true},
+		{"partial read", partial, artifactKind_GChart, statusOperation_Read, false},
+		{"partial write", partial, artifactKind_UserMetric, statusOperation_Write, true},
+		{"partial reads only - write", partialReads, artifactKind_GChart, statusOperation_Write, false},
+		{"partial reads only - read", partialReads, artifactKind_GChart, statusOperation_Read, true},
+		{"partial charts - chart", partialCharts, artifactKind_GChart, statusOperation_Write, true},
+		{"partial charts - metric", partialCharts, artifactKind_UserMetric, statusOperation_Write, false},
+		{"partial metrics - read", partialAll, artifactKind_UserMetric, statusOperation_Read, true},
+		{"partial metrics - chart", partialAll, artifactKind_GChart, statusOperation_Read, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.status.blocks(tt.kind, tt.operation); got != tt.want {
+				t.Errorf("blocks(%q, %q) = %v, want %v", tt.kind, tt.operation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestOperation(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/v1/gchart/1", statusOperation_Read},
+		{http.MethodHead, "/v1/gchartheader", statusOperation_Read},
+		{http.MethodPut, "/v1/gchartuse/1", statusOperation_Read},
+		{http.MethodPut, "/v1/gchart", statusOperation_Write},
+		{http.MethodPost, "/v1/usermetric", statusOperation_Write},
+		{http.MethodDelete, "/v1/gchart/1", statusOperation_Write},
+	}
+
+	for _, tt := range tests {
+		req := restful.NewRequest(httptest.NewRequest(tt.method, tt.path, nil))
+		if got := requestOperation(req); got != tt.want {
+			t.Errorf("%s %s: operation = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -18,13 +18,20 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
 
 	"github.com/emicklei/go-restful"
 )
@@ -42,6 +49,7 @@ type TelemetryEntity struct {
 	UseCount    int64             `datastore:",noindex"`
 	OS          string
 	GCVersion   string
+	Coarsened   bool              // location reduced to the country - skipped by the retention
 }
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -72,6 +80,39 @@ type TelemetryEntityGetAPIv1 struct {
 
 type TelemetryEntityGetAPIv1List []TelemetryEntityGetAPIv1
 
+// values of the "format" query parameter on GET
+const (
+	telemetryFormat_JSON = "json"
+	telemetryFormat_CSV  = "csv"
+)
+
+const mimeTextCSV = "text/csv"
+
+// paged responses return the cursor of the next page in this header
+const cursorHeader = "X-Cursor"
+
+// Result of one retention run
+type TelemetryRetentionAPIv1 struct {
+	Processed int    `json:"processed"`
+	Deleted   int    `json:"deleted"`
+	Coarsened int    `json:"coarsened"`
+	Cursor    string `json:"cursor"` // empty if all outdated entries are processed
+}
+
+// Result of one call of the "Coarsened" migration
+type TelemetryCoarsenedMigrationAPIv1 struct {
+	Processed int    `json:"processed"`
+	Migrated  int    `json:"migrated"`
+	Cursor    string `json:"cursor"` // empty if all entries are processed
+}
+
+// Result of one call of the key migration
+type TelemetryKeyMigrationAPIv1 struct {
+	Processed int    `json:"processed"`
+	Merged    int    `json:"merged"` // entries already recreated at the new key by an update
+	Cursor    string `json:"cursor"` // empty if all entries are processed
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // Data Storage View
 // ---------------------------------------------------------------------------------------------------------------//
@@ -79,6 +120,24 @@ type TelemetryEntityGetAPIv1List []TelemetryEntityGetAPIv1
 const telemetryDBEntityRootKey = "telemetryroot"
 const telemetryDBEntity = "telemetryentity"
 
+// level of location details stored - can be set in app.yaml
+const telemetryLocationConfig = "Telemetry_Location"
+const (
+	telemetryLocation_City    = "city" // default
+	telemetryLocation_Country = "country"
+)
+
+// entries not updated for this number of months are deleted or coarsened to the
+// country (see Telemetry_Retention_Mode) - can be set in app.yaml, 0 keeps all entries
+const telemetryRetentionMonthsConfig = "Telemetry_Retention_Months"
+const telemetryDefaultRetentionMonths = 24
+
+const telemetryRetentionModeConfig = "Telemetry_Retention_Mode"
+const (
+	telemetryRetention_Coarsen = "coarsen" // default
+	telemetryRetention_Delete  = "delete"
+)
+
 func mapAPItoDBTelemetry(api *TelemetryEntityPostAPIv1, db *TelemetryEntity) {
 	if api.LastChange != "" {
 		db.LastChange, _ = time.Parse(dateTimeLayout, api.LastChange)
@@ -103,7 +162,31 @@ func mapDBtoAPITelemetry(db *TelemetryEntity, api *TelemetryEntityGetAPIv1) {
 
 // supporting functions
 
-// telemetryEntityKey returns the key used for all telemetryEntity entries.
+func telemetryCountryOnly() bool {
+	return os.Getenv(telemetryLocationConfig) == telemetryLocation_Country
+}
+
+func telemetryRetentionMonths() int {
+	if months, err := strconv.Atoi(os.Getenv(telemetryRetentionMonthsConfig)); err == nil && months >= 0 {
+		return months
+	}
+	return telemetryDefaultRetentionMonths
+}
+
+// coarsenTelemetry reduces the location to the country, false is returned if there
+// was nothing to remove
+func coarsenTelemetry(db *TelemetryEntity) bool {
+	db.Coarsened = true
+	if db.Region == "" && db.City == "" && db.CityLatLong == "" {
+		return false
+	}
+	db.Region = ""
+	db.City = ""
+	db.CityLatLong = ""
+	return true
+}
+
+// telemetryEntityRootKey returns the ancestor of the entries stored before every entry got its own entity group
 func telemetryEntityRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, telemetryDBEntity, telemetryDBEntityRootKey, 0, nil)
 }
@@ -112,125 +195,398 @@ func telemetryEntityRootKey(ctx context.Context) *datastore.Key {
 // request/response handler
 // ---------------------------------------------------------------------------------------------------------------//
 
-func upsertTelemetry(request *restful.Request, response *restful.Response) {
+// deleteTelemetry removes the entry and history of a user key (opt-out) - deleting an unknown key is not an error
+func deleteTelemetry(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
-	telemetry := new(TelemetryEntityPostAPIv1)
-	if err := request.ReadEntity(telemetry); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	userKey := request.PathParameter("key")
+
+	// updates still queued must not recreate the entry
+	tombstone := &TelemetryTombstoneEntity{DeleteDate: time.Now().UTC()}
+	if _, err := datastore.Put(ctx, telemetryTombstoneKey(ctx, userKey), tombstone); err != nil {
+		commonResponseErrorProcessing(response, err)
 		return
 	}
-	// set Increment if not yet set (just in case)
-	if telemetry.Increment == 0 {
-		telemetry.Increment = 1
+
+	keys := []*datastore.Key{telemetryEntityKey(ctx, userKey), legacyTelemetryEntityKey(ctx, userKey)}
+	if err := deleteTelemetryKeys(ctx, keys); err != nil && err != datastore.ErrNoSuchEntity {
+		commonResponseErrorProcessing(response, err)
+		return
 	}
 
-	// No checks if the necessary fields are filed or not - since GoldenCheetah is
-	// the only consumer of the APIs - any checks/response are to support this use-case
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
 
-	// read if there is an entry existing for this IP Address
-	key := datastore.NewKey(ctx, telemetryDBEntity, telemetry.UserKey, 0, telemetryEntityRootKey(ctx))
+// applyTelemetryRetention deletes or coarsens entries which were not updated within the
+// retention period - it's called by cron, a run stops after some time and continues itself
+// with a push task for the returned "cursor"
+func applyTelemetryRetention(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
 
-	currentTelemetry := new(TelemetryEntity)
-	err := datastore.Get(ctx, key, currentTelemetry)
-	if err == nil {
-		// entry found, increment counter
-		currentTelemetry.UseCount += telemetry.Increment
-	} else {
-		// entry not found, create a new one
-		currentTelemetry.Country = request.HeaderParameter("X-AppEngine-Country")
-		currentTelemetry.Region = request.HeaderParameter("X-AppEngine-Region")
-		currentTelemetry.City = request.HeaderParameter("X-AppEngine-City")
-		currentTelemetry.CityLatLong = request.HeaderParameter("X-AppEngine-CityLatLong")
-		currentTelemetry.UseCount = 1
-		currentTelemetry.CreateDate = time.Now()
-	}
-	// general mapping
-	mapAPItoDBTelemetry(telemetry, currentTelemetry)
-
-	if _, err := datastore.Put(ctx, key, currentTelemetry); err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	const maxDurationPerCall = 30 * time.Second
+	const batchSize = 500
+
+	var result TelemetryRetentionAPIv1
+
+	cursorString := request.QueryParameter("cursor")
+	if cursorString == "" {
+		// once per run
+		if err := deleteExpiredTelemetryTombstones(ctx); err != nil {
+			log.Warningf(ctx, "Deleting expired telemetry tombstones failed: %v", err)
 		}
+	}
+
+	months := telemetryRetentionMonths()
+	if months == 0 {
+		// retention disabled
+		response.WriteHeaderAndEntity(http.StatusOK, result)
 		return
 	}
+	cutoff := time.Now().AddDate(0, -months, 0)
+	deleteMode := os.Getenv(telemetryRetentionModeConfig) == telemetryRetention_Delete
 
-	response.WriteHeaderAndEntity(http.StatusCreated, currentTelemetry)
+	q := datastore.NewQuery(telemetryDBEntity)
+	if !deleteMode {
+		// entries already coarsened stay outdated - don't read them with every run (see index.yaml)
+		q = q.Filter("Coarsened =", false)
+	}
+	q = q.Filter("LastChange <", cutoff)
+	if cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
 
+	start := time.Now()
+	t := q.Run(ctx)
+	done := false
+	for !done && time.Since(start) < maxDurationPerCall {
+		var keys []*datastore.Key
+		var telemetryOnDBList []TelemetryEntity
+		for len(keys) < batchSize && time.Since(start) < maxDurationPerCall {
+			telemetryDB := new(TelemetryEntity)
+			key, err := t.Next(telemetryDB)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			result.Processed++
+			if deleteMode {
+				keys = append(keys, key)
+			} else {
+				// stored even without location details - to set the flag
+				if coarsenTelemetry(telemetryDB) {
+					result.Coarsened++
+				}
+				keys = append(keys, key)
+				telemetryOnDBList = append(telemetryOnDBList, *telemetryDB)
+			}
+		}
+
+		if len(keys) > 0 {
+			var err error
+			if deleteMode {
+				err = deleteTelemetryKeys(ctx, keys)
+				result.Deleted += len(keys)
+			} else {
+				_, err = datastore.PutMulti(ctx, keys, telemetryOnDBList)
+			}
+			if err != nil {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+		}
+	}
 
+	if !done {
+		cursor, err := t.Cursor()
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Cursor = cursor.String()
+
+		// continue with the next bucket - cron only starts the run once a day
+		task := &taskqueue.Task{Method: "GET", Path: "/v1/telemetryretention?cursor=" + url.QueryEscape(result.Cursor)}
+		if _, err := taskqueue.Add(ctx, task, ""); err != nil {
+			// continued with the next cron run
+			log.Errorf(ctx, "Queueing the telemetry retention failed: %v", err)
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
 }
 
-func getTelemetry(request *restful.Request, response *restful.Response) {
+// migrateTelemetryKeys moves a bucket of entries stored below the common ancestor to their own
+// entity groups (see telemetryEntityKey())
+func migrateTelemetryKeys(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
-	oldestDate := time.Date(2000, time.January, 1,0,0,0,0, time.UTC)
-	var createdAfter time.Time
-	var updatedAfter time.Time
-	var err error
-	if dateString := request.QueryParameter("createdAfter"); dateString != "" {
-		createdAfter, err = time.Parse(time.RFC3339, dateString)
+	const maxDurationPerCall = 30 * time.Second
+	// an XG transaction spans max. 25 entity groups - the legacy one and one per entry
+	const batchSize = 24
+
+	q := datastore.NewQuery(telemetryDBEntity).Ancestor(telemetryEntityRootKey(ctx)).KeysOnly()
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " 'createdAfter' - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid cursor", err)
 			return
 		}
-	} else {
-		createdAfter = oldestDate
+		q = q.Start(cursor)
 	}
-	if dateString := request.QueryParameter("updatedAfter"); dateString != "" {
-		updatedAfter, err = time.Parse(time.RFC3339, dateString)
+
+	var result TelemetryKeyMigrationAPIv1
+	start := time.Now()
+	t := q.Run(ctx)
+	done := false
+	for !done && time.Since(start) < maxDurationPerCall {
+		var legacyKeys []*datastore.Key
+		for len(legacyKeys) < batchSize {
+			key, err := t.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			legacyKeys = append(legacyKeys, key)
+		}
+		if len(legacyKeys) > 0 {
+			merged, err := moveLegacyTelemetry(ctx, legacyKeys)
+			if err != nil {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			result.Processed += len(legacyKeys)
+			result.Merged += merged
+		}
+	}
+
+	if !done {
+		cursor, err := t.Cursor()
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " 'updatedAfter' - Correct format is RFC3339"))
+			commonResponseErrorProcessing(response, err)
 			return
 		}
-	} else {
-		updatedAfter = oldestDate
+		result.Cursor = cursor.String()
 	}
-	os := request.QueryParameter("os")
-	version := request.QueryParameter("version")
 
-	// only one query parameter is processed on the request in case of multiple parameters,
-	// follow the priority given by the sequence below (and ignore the other parameters)
-	var q* datastore.Query
-	if createdAfter != oldestDate {
-		q = datastore.NewQuery(telemetryDBEntity).
-			Filter("CreateDate >=", createdAfter)
-	} else if updatedAfter != oldestDate {
-		q = datastore.NewQuery(telemetryDBEntity).
-			Filter("LastChange >=", updatedAfter)
-	} else if os != "" {
-		q = datastore.NewQuery(telemetryDBEntity).
-			Filter("OS =", os)
-	} else if version != "" {
-		q = datastore.NewQuery(telemetryDBEntity).
-			Filter("GCVersion =", version)
-	} else {
-		q = datastore.NewQuery(telemetryDBEntity)
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+// migrateTelemetryCoarsened sets the "Coarsened" flag of a bucket of entries stored before the
+// flag was introduced - the retention query does not find entries without the flag
+func migrateTelemetryCoarsened(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const maxDurationPerCall = 30 * time.Second
+	const batchSize = 500
+
+	q := datastore.NewQuery(telemetryDBEntity)
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
 	}
 
-	var telemetryList TelemetryEntityGetAPIv1List
+	var result TelemetryCoarsenedMigrationAPIv1
+	start := time.Now()
+	t := q.Run(ctx)
+	done := false
+	for !done && time.Since(start) < maxDurationPerCall {
+		var keys []*datastore.Key
+		var telemetryOnDBList []TelemetryEntity
+		for len(keys) < batchSize && time.Since(start) < maxDurationPerCall {
+			telemetryDB := new(TelemetryEntity)
+			key, err := t.Next(telemetryDB)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			result.Processed++
+			// the flag is missing on old entries - writing the entity stores it
+			telemetryDB.Coarsened = telemetryDB.Region == "" && telemetryDB.City == "" && telemetryDB.CityLatLong == ""
+			keys = append(keys, key)
+			telemetryOnDBList = append(telemetryOnDBList, *telemetryDB)
+		}
+		if len(keys) > 0 {
+			if _, err := datastore.PutMulti(ctx, keys, telemetryOnDBList); err != nil {
+				commonResponseErrorProcessing(response, err)
+				return
+			}
+			result.Migrated += len(keys)
+		}
+	}
+
+	if !done {
+		cursor, err := t.Cursor()
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Cursor = cursor.String()
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
+// getTelemetry returns the entries matching all given filters - paged, continue with the
+// cursor returned in the "X-Cursor" header, as JSON or CSV ("format" or Accept header)
+func getTelemetry(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const defaultPageSize = 500
+	const maxPageSize = 5000
+	// filters applied here may skip most of the entries - a page ends after this many,
+	// even if it's not full
+	const maxScannedPerCall = 20000
+
+	createdAfter, ok := readTelemetryTime(request, response, "createdAfter", time.Time{})
+	if !ok {
+		return
+	}
+	updatedAfter, ok := readTelemetryTime(request, response, "updatedAfter", time.Time{})
+	if !ok {
+		return
+	}
+	operatingSystem := request.QueryParameter("os")
+	version := request.QueryParameter("version")
 
-	var telemetryOnDBList []TelemetryEntity
-	k, err := q.GetAll(ctx, &telemetryOnDBList)
-	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+	pageSize := defaultPageSize
+	if limitString := request.QueryParameter("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			addInvalidRequestError(response, fmt.Sprintf("Invalid limit - must be between 1 and %d", maxPageSize), err)
+			return
 		}
+		pageSize = limit
+	}
+
+	csvOutput := false
+	switch request.QueryParameter("format") {
+	case "":
+		csvOutput = strings.Contains(request.HeaderParameter("Accept"), mimeTextCSV)
+	case telemetryFormat_JSON:
+	case telemetryFormat_CSV:
+		csvOutput = true
+	default:
+		addInvalidRequestError(response, "Invalid format - must be 'json' or 'csv'", nil)
 		return
 	}
 
-	// DB Entity needs to be mapped back
-	for i, telemetryDB := range telemetryOnDBList {
+	// equality filters can be combined without a composite index, but only one inequality
+	// filter is possible - all filters not done by the datastore are applied here
+	q := datastore.NewQuery(telemetryDBEntity)
+	if operatingSystem != "" {
+		q = q.Filter("OS =", operatingSystem)
+	}
+	if version != "" {
+		q = q.Filter("GCVersion =", version)
+	}
+	filterCreated := !createdAfter.IsZero()
+	filterUpdated := !updatedAfter.IsZero()
+	if operatingSystem == "" && version == "" {
+		if filterCreated {
+			q = q.Filter("CreateDate >=", createdAfter)
+			filterCreated = false
+		} else if filterUpdated {
+			q = q.Filter("LastChange >=", updatedAfter)
+			filterUpdated = false
+		}
+	}
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	telemetryList := TelemetryEntityGetAPIv1List{}
+	t := q.Run(ctx)
+	done := false
+	for scanned := 0; len(telemetryList) < pageSize && scanned < maxScannedPerCall; scanned++ {
+		var telemetryDB TelemetryEntity
+		key, err := t.Next(&telemetryDB)
+		if err == datastore.Done {
+			done = true
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		if filterCreated && telemetryDB.CreateDate.Before(createdAfter) {
+			continue
+		}
+		if filterUpdated && telemetryDB.LastChange.Before(updatedAfter) {
+			continue
+		}
+
+		// DB Entity needs to be mapped back
 		var telemetryAPI TelemetryEntityGetAPIv1
 		mapDBtoAPITelemetry(&telemetryDB, &telemetryAPI)
-		telemetryAPI.UserKey = k[i].StringID()
+		telemetryAPI.UserKey = key.StringID()
 		telemetryList = append(telemetryList, telemetryAPI)
 	}
 
+	// a full page (or one ended by the scan limit) may be followed by more entries
+	if !done {
+		cursor, err := t.Cursor()
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		response.AddHeader(cursorHeader, cursor.String())
+	}
+
+	if csvOutput {
+		writeTelemetryCSV(response, telemetryList)
+		return
+	}
+
 	response.WriteHeaderAndEntity(http.StatusOK, telemetryList)
 }
+
+func writeTelemetryCSV(response *restful.Response, telemetryList TelemetryEntityGetAPIv1List) {
+	response.AddHeader("Content-Type", mimeTextCSV)
+	response.AddHeader("Content-Disposition", "attachment; filename=telemetry.csv")
+	response.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(response)
+	w.Write([]string{"key", "country", "region", "city", "cityLatLong", "createDate", "lastChange", "useCount", "operatingSystem", "version"})
+	for _, telemetry := range telemetryList {
+		w.Write([]string{
+			telemetry.UserKey,
+			telemetry.Country,
+			telemetry.Region,
+			telemetry.City,
+			telemetry.CityLatLong,
+			telemetry.CreateDate,
+			telemetry.LastChange,
+			strconv.FormatInt(telemetry.UseCount, 10),
+			telemetry.OS,
+			telemetry.GCVersion,
+		})
+	}
+	w.Flush()
+}
@@ -21,9 +21,9 @@ package main
 import (
 	"google.golang.org/appengine/log"
 	"net/http"
+	"sort"
 	"time"
 	"strconv"
-	"fmt"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -38,13 +38,18 @@ import (
 // ---------------------------------------------------------------------------------------------------------------//
 type UserMetricEntity struct {
 	Header       CommonEntityHeader
-	MetricXML    string       `datastore:",noindex"`
+	MetricXML    string       `datastore:",noindex"` // only if TextEncoding is plain
+	MetricXMLGz  []byte       `datastore:",noindex"` // only if TextEncoding is gzip
+	TextEncoding int          `datastore:",noindex"`
+	ContentHash  string       // hash of the normalized MetricXML
 	CreatorNick  string       `datastore:",noindex"`
-	CreatorEmail string       `datastore:",noindex"`
+	CreatorEmail string       `datastore:",noindex"` // only for artifacts stored before the creator profiles
+	Curation     CommonEntityCuration
 }
 
 type UserMetricEntityHeaderOnly struct {
-	Header CommonEntityHeader
+	Header   CommonEntityHeader
+	Curation CommonEntityCuration
 }
 
 
@@ -58,6 +63,7 @@ type UserMetricAPIv1 struct {
 	MetricXML    string      `json:"metrictxml"`
 	CreatorNick  string      `json:"creatorNick"`
 	CreatorEmail string      `json:"creatorEmail"`
+	Curation     *CurationAPIv1 `json:"curation,omitempty"` // GET only
 }
 
 type UserMetricAPIv1List []UserMetricAPIv1
@@ -68,6 +74,15 @@ type UserMetricAPIv1HeaderOnly struct {
 }
 type UserMetricAPIv1HeaderOnlyList []UserMetricAPIv1HeaderOnly
 
+// headers returns the common headers of the listing (e.g. to add the rating aggregates)
+func (list UserMetricAPIv1HeaderOnlyList) headers() []*CommonAPIHeaderV1 {
+	headers := make([]*CommonAPIHeaderV1, len(list))
+	for i := range list {
+		headers[i] = &list[i].Header
+	}
+	return headers
+}
+
 
 
 // ---------------------------------------------------------------------------------------------------------------//
@@ -77,19 +92,35 @@ type UserMetricAPIv1HeaderOnlyList []UserMetricAPIv1HeaderOnly
 const usermetricDBEntity = "usermetricentity"
 const usermetricDBEntityRootKey = "usermetricroot"
 
-func mapAPItoDBUserMetric(api *UserMetricAPIv1, db *UserMetricEntity) {
+func mapAPItoDBUserMetric(api *UserMetricAPIv1, db *UserMetricEntity) error {
 	mapAPItoDBCommonHeader(&api.Header, &db.Header)
-	db.MetricXML = api.MetricXML
+	db.ContentHash = contentHash(api.MetricXML)
+	metricXML, err := compressText(api.MetricXML)
+	if err != nil {
+		return err
+	}
+	db.MetricXML = ""
+	db.MetricXMLGz = metricXML
+	db.TextEncoding = textEncoding_Gzip
+	// nickname (fallback) and email are taken from the creator profile on GET - see resolveCreator()
 	db.CreatorNick = api.CreatorNick
-	db.CreatorEmail = api.CreatorEmail
+	db.CreatorEmail = ""
+	return nil
 }
 
 
-func mapDBtoAPIUserMetric(db* UserMetricEntity, api *UserMetricAPIv1) {
+func mapDBtoAPIUserMetric(db* UserMetricEntity, api *UserMetricAPIv1) error {
 	mapDBtoAPICommonHeader(&db.Header, &api.Header)
-	api.MetricXML = db.MetricXML
+	metricXML, err := decodeText(db.TextEncoding, db.MetricXML, db.MetricXMLGz)
+	if err != nil {
+		return err
+	}
+	api.MetricXML = metricXML
 	api.CreatorNick = db.CreatorNick
 	api.CreatorEmail = db.CreatorEmail
+	api.Curation = new(CurationAPIv1)
+	mapDBtoAPICuration(&db.Header, &db.Curation, api.Curation)
+	return nil
 }
 
 
@@ -101,6 +132,12 @@ func usermetricEntityRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, usermetricDBEntity, usermetricDBEntityRootKey, 0, nil)
 }
 
+// clearUserMetricContent removes everything but the header of a deleted user metric
+func clearUserMetricContent(metricDB *UserMetricEntity) {
+	metricDB.MetricXML = ""
+	metricDB.MetricXMLGz = nil
+}
+
 // ---------------------------------------------------------------------------------------------------------------//
 // request/response handler
 // ---------------------------------------------------------------------------------------------------------------//
@@ -110,7 +147,7 @@ func insertUserMetric(request *restful.Request, response *restful.Response) {
 
 	metric := new(UserMetricAPIv1)
 	if err := request.ReadEntity(metric); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
@@ -118,30 +155,35 @@ func insertUserMetric(request *restful.Request, response *restful.Response) {
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
 	metricDB := new(UserMetricEntity)
-	mapAPItoDBUserMetric(metric, metricDB)
+	if err := mapAPItoDBUserMetric(metric, metricDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
 
 	// complete/set POST fields
 	metricDB.Header.LastChanged = time.Now()
 	metricDB.Header.Curated = false
 	metricDB.Header.Deleted = false
 
-	// auto-curate if a registered "curator" is adding user metric
-	curatorQuery := datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", metricDB.Header.CreatorId)
-	counter, _ := curatorQuery.Count(ctx) // ignore errors/just leave uncurated
-	if counter == 1 {
-		metricDB.Header.Curated = true
-	} else {
-		metricDB.Header.Curated = false
+	// exact duplicates of existing user metrics are rejected or flagged
+	if !checkDuplicate(ctx, request, response, usermetricDBEntity, metricDB.ContentHash) {
+		return
 	}
 
+	// auto-curate if a registered "curator" is adding user metric
+	metricDB.Header.Curated = isCurator(ctx, metricDB.Header.CreatorId, artifactKind_UserMetric, "")
+	initCuration(&metricDB.Header, &metricDB.Curation)
+
 	// and now store it
 	key := datastore.NewIncompleteKey(ctx, usermetricDBEntity, usermetricEntityRootKey(ctx))
 	key, err := datastore.Put(ctx, key, metricDB)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
+	ensureCreator(ctx, metricDB.Header.CreatorId, metric.CreatorNick, metric.CreatorEmail, request.HeaderParameter(creatorSecretHeader))
+
 	// send back the key
 	response.WriteHeaderAndEntity(http.StatusCreated, strconv.FormatInt(key.IntID(), 10))
 
@@ -152,30 +194,46 @@ func updateUserMetric(request *restful.Request, response *restful.Response) {
 
 	metric := new(UserMetricAPIv1)
 	if err := request.ReadEntity(metric); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
 	if metric.Header.Id == 0 {
-		addPlainTextError(response, http.StatusBadRequest, "Mandatory Key for Update is missing or invalid")
+		addInvalidRequestError(response, "Mandatory Key for Update is missing or invalid", nil)
 		return
 	}
 
 	// No more checks if the necessary fields are filled or not - since GoldenCheetah is
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
+	key := datastore.NewKey(ctx, usermetricDBEntity, "", metric.Header.Id, usermetricEntityRootKey(ctx))
+
+	// get the current metric to retrieve the curation state
+	currentMetricDB := new(UserMetricEntity)
+	err := datastore.Get(ctx, key, currentMetricDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
 	metricDB := new(UserMetricEntity)
-	mapAPItoDBUserMetric(metric, metricDB)
+	if err := mapAPItoDBUserMetric(metric, metricDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	metricDB.Curation = currentMetricDB.Curation
+	preserveCommonHeader(&currentMetricDB.Header, &metricDB.Header)
 	metricDB.Header.LastChanged = time.Now()
 
 	// and now store it
 
-	key := datastore.NewKey(ctx, usermetricDBEntity, "", metric.Header.Id, usermetricEntityRootKey(ctx))
 	if _, err := datastore.Put(ctx, key, metricDB); err != nil {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
+	ensureCreator(ctx, metricDB.Header.CreatorId, metric.CreatorNick, metric.CreatorEmail, request.HeaderParameter(creatorSecretHeader))
+
 	// Response is Empty for 204
 	response.WriteHeaderAndEntity(http.StatusNoContent, "")
 
@@ -189,7 +247,7 @@ func getUserMetricHeader(request *restful.Request, response *restful.Response) {
 	if dateString = request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid dateFrom - correct format is RFC3339", err)
 			return
 		}
 	} else {
@@ -205,14 +263,14 @@ func getUserMetricHeader(request *restful.Request, response *restful.Response) {
 	var metricsOnDBList []UserMetricEntityHeaderOnly
 	k, err := q.GetAll(ctx, &metricsOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
 	// DB Entity needs to be mapped back
 	for i, metricDB := range metricsOnDBList {
 		var metric UserMetricAPIv1HeaderOnly
-		mapDBtoAPICommonHeader(&metricDB.Header, &metric.Header)
+		mapDBtoAPICommonHeaderForListing(&metricDB.Header, &metric.Header)
 		metric.Header.Id = k[i].IntID()
 		metricHeaderList = append(metricHeaderList, metric)
 	}
@@ -220,10 +278,55 @@ func getUserMetricHeader(request *restful.Request, response *restful.Response) {
 	// write Info Log
 	log.Infof(ctx, "GetHeader from: %s", dateString )
 
+	addRatingAggregates(ctx, artifactKind_UserMetric, metricHeaderList.headers())
+
 	response.WriteHeaderAndEntity(http.StatusOK, metricHeaderList)
 
 }
 
+func getUserMetricDuplicates(request *restful.Request, response *restful.Response) {
+
+	getDuplicates(request, response, artifactKind_UserMetric, usermetricDBEntity)
+
+}
+
+// getUserMetricHeaderByCreator lists all user metrics of a creator - newest first
+func getUserMetricHeaderByCreator(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	q := datastore.NewQuery(usermetricDBEntity).Filter("Header.CreatorId =", request.PathParameter("creatorId"))
+
+	var metricsOnDBList []UserMetricEntityHeaderOnly
+	k, err := q.GetAll(ctx, &metricsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	includeDeleted := includeDeletedForOwner(ctx, request)
+
+	// DB Entity needs to be mapped back
+	metricHeaderList := UserMetricAPIv1HeaderOnlyList{}
+	for i, metricDB := range metricsOnDBList {
+		if !includeDeleted && (metricDB.Header.Deleted || metricDB.Header.Hidden) {
+			continue
+		}
+		var metric UserMetricAPIv1HeaderOnly
+		mapDBtoAPICommonHeader(&metricDB.Header, &metric.Header)
+		metric.Header.Id = k[i].IntID()
+		metricHeaderList = append(metricHeaderList, metric)
+	}
+
+	// sorted here to avoid a composite index
+	sort.Slice(metricHeaderList, func(i, j int) bool {
+		return metricHeaderList[i].Header.LastChanged > metricHeaderList[j].Header.LastChanged
+	})
+
+	addRatingAggregates(ctx, artifactKind_UserMetric, metricHeaderList.headers())
+
+	response.WriteHeaderAndEntity(http.StatusOK, metricHeaderList)
+}
+
 func getUserMetricHeaderCount(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
@@ -232,7 +335,7 @@ func getUserMetricHeaderCount(request *restful.Request, response *restful.Respon
 	if dateString := request.QueryParameter("dateFrom"); dateString != "" {
 		date, err = time.Parse(time.RFC3339, dateString)
 		if err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Correct format is RFC3339"))
+			addInvalidRequestError(response, "Invalid dateFrom - correct format is RFC3339", err)
 			return
 		}
 	} else {
@@ -252,7 +355,7 @@ func getUserMetricById(request *restful.Request, response *restful.Response) {
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		commonResponseErrorProcessing (response, err)
+		addInvalidRequestError(response, "Invalid id", err)
 		return
 	}
 
@@ -261,15 +364,24 @@ func getUserMetricById(request *restful.Request, response *restful.Response) {
 	metricDB := new(UserMetricEntity)
 	err = datastore.Get(ctx, key, metricDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
 
 	// now map and respond
 	metric := new(UserMetricAPIv1)
-	mapDBtoAPIUserMetric(metricDB, metric)
+	if err := mapDBtoAPIUserMetric(metricDB, metric); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
 	metric.Header.Id= key.IntID()
+	addRatingAggregates(ctx, artifactKind_UserMetric, []*CommonAPIHeaderV1{&metric.Header})
+	resolveCreator(ctx, metricDB.Header.CreatorId, &metric.CreatorNick, &metric.CreatorEmail)
+	// the email is personal data - only available to the creator, admins and curators
+	if !canSeeCreatorEmail(ctx, request, metricDB.Header.CreatorId, artifactKind_UserMetric, "") {
+		metric.CreatorEmail = ""
+	}
 
 	response.WriteHeaderAndEntity(http.StatusOK, metric)
 }
@@ -285,13 +397,170 @@ func curateUserMetricById(request *restful.Request, response *restful.Response)
 	newStatusString := request.QueryParameter("newStatus")
 	b, err := strconv.ParseBool(newStatusString)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addInvalidRequestError(response, "Invalid newStatus - must be 'true' or 'false'", err)
 		return
 	}
 	changeUserMetricById(request, response, false, true, b)
 
 }
 
+func reviewUserMetricById(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	review, ok := readCurationReview(request, response)
+	if !ok {
+		return
+	}
+
+	key := datastore.NewKey(ctx, usermetricDBEntity, "", i, usermetricEntityRootKey(ctx))
+
+	metricDB := new(UserMetricEntity)
+	err = datastore.Get(ctx, key, metricDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	if !checkCurationPermission(ctx, response, review.CuratorId, artifactKind_UserMetric, "") {
+		return
+	}
+
+	applyCurationReview(review, &metricDB.Header, &metricDB.Curation)
+
+	if _, err := datastore.Put(ctx, key, metricDB); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// Response is Empty for 204
+	response.WriteHeaderAndEntity(http.StatusNoContent, "")
+}
+
+func getUserMetricCurationById(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	id := request.PathParameter("id")
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		addInvalidRequestError(response, "Invalid id", err)
+		return
+	}
+
+	key := datastore.NewKey(ctx, usermetricDBEntity, "", i, usermetricEntityRootKey(ctx))
+
+	metricDB := new(UserMetricEntityHeaderOnly)
+	err = datastore.Get(ctx, key, metricDB)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	var curation CurationAPIv1
+	mapDBtoAPICuration(&metricDB.Header, &metricDB.Curation, &curation)
+	curation.Id = key.IntID()
+
+	response.WriteHeaderAndEntity(http.StatusOK, curation)
+}
+
+// getUserMetricCurationQueue returns the headers of all user metrics waiting for review - oldest first
+func getUserMetricCurationQueue(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	q := datastore.NewQuery(usermetricDBEntity).Filter("Header.Curated =", false).Filter("Header.Deleted =", false)
+
+	var metricsOnDBList []UserMetricEntityHeaderOnly
+	k, err := q.GetAll(ctx, &metricsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// DB Entity needs to be mapped back - rejected metrics are not in the queue
+	metricHeaderList := UserMetricAPIv1HeaderOnlyList{}
+	for i, metricDB := range metricsOnDBList {
+		if curationState(&metricDB.Header, &metricDB.Curation) != curationState_Pending {
+			continue
+		}
+		var metric UserMetricAPIv1HeaderOnly
+		mapDBtoAPICommonHeader(&metricDB.Header, &metric.Header)
+		metric.Header.Id = k[i].IntID()
+		metricHeaderList = append(metricHeaderList, metric)
+	}
+	sort.Slice(metricHeaderList, func(i, j int) bool {
+		return metricHeaderList[i].Header.LastChanged < metricHeaderList[j].Header.LastChanged
+	})
+
+	addRatingAggregates(ctx, artifactKind_UserMetric, metricHeaderList.headers())
+
+	response.WriteHeaderAndEntity(http.StatusOK, metricHeaderList)
+}
+
+// migrateUserMetricContentHashes stores the content hash of user metrics stored before it was
+// introduced - only a bucket of user metrics is processed per call (continue with "cursor")
+func migrateUserMetricContentHashes(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const maxNumberOfMetricsPerCall = 50
+
+	q := datastore.NewQuery(usermetricDBEntity).Ancestor(usermetricEntityRootKey(ctx))
+	if cursorString := request.QueryParameter("cursor"); cursorString != "" {
+		cursor, err := datastore.DecodeCursor(cursorString)
+		if err != nil {
+			addInvalidRequestError(response, "Invalid cursor", err)
+			return
+		}
+		q = q.Start(cursor)
+	}
+
+	var result ContentHashMigrationAPIv1
+	t := q.Run(ctx)
+	for result.Processed < maxNumberOfMetricsPerCall {
+		metricDB := new(UserMetricEntity)
+		key, err := t.Next(metricDB)
+		if err == datastore.Done {
+			// all user metrics processed
+			response.WriteHeaderAndEntity(http.StatusOK, result)
+			return
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Processed++
+
+		if metricDB.ContentHash != "" || metricDB.Header.Deleted {
+			continue
+		}
+		metricXML, err := decodeText(metricDB.TextEncoding, metricDB.MetricXML, metricDB.MetricXMLGz)
+		if err != nil {
+			log.Warningf(ctx, "User metric %d not readable - no content hash: %v", key.IntID(), err)
+			continue
+		}
+		metricDB.ContentHash = contentHash(metricXML)
+		if _, err := datastore.Put(ctx, key, metricDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		result.Migrated++
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	result.Cursor = cursor.String()
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
+
 // ------------------- supporting functions ------------------------------------------------
 
 func changeUserMetricById(request *restful.Request, response *restful.Response, changeDeleted bool, changeCurated bool, newStatus bool) {
@@ -300,7 +569,7 @@ func changeUserMetricById(request *restful.Request, response *restful.Response,
 	id := request.PathParameter("id")
 	i, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
-		addPlainTextError(response, http.StatusBadRequest, err.Error())
+		addInvalidRequestError(response, "Invalid id", err)
 		return
 	}
 
@@ -309,7 +578,7 @@ func changeUserMetricById(request *restful.Request, response *restful.Response,
 	metricDB := new(UserMetricEntity)
 	err = datastore.Get(c, key, metricDB)
 	if err != nil && !isErrFieldMismatch(err) {
-		commonResponseErrorProcessing (response, err)
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -318,23 +587,23 @@ func changeUserMetricById(request *restful.Request, response *restful.Response,
 	if changeDeleted {
 		metricDB.Header.Deleted = newStatus
 		if newStatus {
-			metricDB.MetricXML = ""
+			clearUserMetricContent(metricDB)
 		}
 		metricDB.Header.LastChanged = time.Now()
 	}
 
 	if changeCurated {
-		metricDB.Header.Curated = newStatus
+		// the curator must be allowed to curate the artifact kind (and sport)
+		curatorId := request.QueryParameter("curatorId")
+		if !checkCurationPermission(c, response, curatorId, artifactKind_UserMetric, "") {
+			return
+		}
+		setCuration(&metricDB.Header, &metricDB.Curation, newStatus, curatorId)
 		metricDB.Header.LastChanged = time.Now()
 	}
 
 	if _, err := datastore.Put(c, key, metricDB); err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
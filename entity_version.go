@@ -21,7 +21,7 @@ package main
 import (
 	"net/http"
 	"strconv"
-	"fmt"
+	"strings"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
@@ -35,10 +35,13 @@ import (
 // Golden Cheetah curator (versionentity) which is stored in DB
 // ---------------------------------------------------------------------------------------------------------------//
 type VersionEntity struct {
-	Version     int
+	Version     int          // build number
+	SemanticVersion string   `datastore:",noindex"` // normalized, e.g. "3.5.0-rc1"
 	Type        int          `datastore:",noindex"`
-	URL         string       `datastore:",noindex"`
-	Text        string       `datastore:",noindex"`
+	URL         string       `datastore:",noindex"` // generic download (all platforms)
+	Downloads   []VersionDownload // platform specific downloads
+	Text        string       `datastore:",noindex"` // English
+	Texts       []LocalizedText // translations
 	VersionText string       `datastore:",noindex"`
 }
 
@@ -49,6 +52,19 @@ const (
 	Version_Development_Build = 30
 )
 
+// Channels a user can subscribe to - each channel includes the more stable release types
+const (
+	versionChannel_Release     = "release"     // Version_Release
+	versionChannel_RC          = "rc"          // + Version_Release_Candidate
+	versionChannel_Development = "development" // + Version_Development_Build
+)
+
+// VersionDownload is the installer of a version for one platform
+type VersionDownload struct {
+	OS       string `datastore:",noindex"` // e.g. "windows", "macos", "linux"
+	URL      string `datastore:",noindex"`
+	Checksum string `datastore:",noindex"` // e.g. "sha256:<hex>"
+}
 
 type VersionEntityText struct {
 	Text string                 `datastore:",noindex"`
@@ -61,21 +77,33 @@ type VersionEntityText struct {
 // Full structure for POST/PUT
 type VersionEntityPostAPIv1 struct {
 	Version     int          `json:"version"`
+	SemanticVersion string   `json:"semanticVersion"` // optional - e.g. "3.5.0-rc1" or "3.5 RC1"
 	Type        int          `json:"releaseType"`
 	URL         string       `json:"downloadURL"`
+	Downloads   []VersionDownloadAPIv1 `json:"downloads"` // optional - per platform
 	VersionText string       `json:"versionText"`
-	Text        string       `json:"text"`
+	Text        string       `json:"text"`  // English
+	Texts       map[string]string `json:"texts"` // optional - translations by language (e.g. "de")
 }
 
 type VersionEntityGetAPIv1 struct {
 	Id          int64        `json:"id"`
 	Version     int          `json:"version"`
+	SemanticVersion string   `json:"semanticVersion,omitempty"`
 	Type        int          `json:"releaseType"`
-	URL         string       `json:"downloadURL"`
+	URL         string       `json:"downloadURL"` // of the requested OS (if there is one)
+	Checksum    string       `json:"checksum,omitempty"` // of the requested OS download
+	Downloads   []VersionDownloadAPIv1 `json:"downloads,omitempty"`
 	VersionText string       `json:"versionText"`
+	Language    string       `json:"language"` // of the text - best match for Accept-Language
 	Text        string       `json:"text"`
 }
 
+type VersionDownloadAPIv1 struct {
+	OS       string `json:"os"`
+	URL      string `json:"downloadURL"`
+	Checksum string `json:"checksum"`
+}
 
 type VersionEntityGetAPIv1List []VersionEntityGetAPIv1
 
@@ -89,23 +117,112 @@ const versionDBEntity = "versionentity"
 
 func mapAPItoDBVersion(api *VersionEntityPostAPIv1, db *VersionEntity) {
 	db.Version = api.Version
+	if semVer, err := parseSemanticVersion(api.SemanticVersion); err == nil {
+		db.SemanticVersion = semVer.String()
+	}
 	db.Type = api.Type
 	db.URL = api.URL
+	db.Downloads = nil
+	for _, download := range api.Downloads {
+		db.Downloads = append(db.Downloads, VersionDownload{OS: strings.ToLower(download.OS), URL: download.URL, Checksum: download.Checksum})
+	}
 	db.Text = api.Text
+	db.Texts = mapAPItoDBLocalizedTexts(api.Texts)
 	db.VersionText = api.VersionText
 }
 
-func mapDBtoAPIVersion(db *VersionEntity, api *VersionEntityGetAPIv1) {
+func mapDBtoAPIVersion(db *VersionEntity, api *VersionEntityGetAPIv1, languages []string) {
 	api.Version = db.Version
+	api.SemanticVersion = db.SemanticVersion
 	api.Type = db.Type
 	api.URL = db.URL
-	api.Text = db.Text
+	for _, download := range db.Downloads {
+		api.Downloads = append(api.Downloads, VersionDownloadAPIv1{OS: download.OS, URL: download.URL, Checksum: download.Checksum})
+	}
+	api.Language, api.Text = localizedText(languages, db.Text, db.Texts)
 	api.VersionText = db.VersionText
 }
 
 
 // supporting functions
 
+// versionTypesOfChannel returns the highest release type a channel includes - 0 for an unknown channel
+func versionTypesOfChannel(channel string) int {
+	switch strings.ToLower(channel) {
+	case versionChannel_Release:
+		return Version_Release
+	case versionChannel_RC:
+		return Version_Release_Candidate
+	case versionChannel_Development:
+		return Version_Development_Build
+	}
+	return 0
+}
+
+// semVer returns the semantic version - for versions stored without one the version text
+// (e.g. "3.5 RC1") is used if it can be parsed
+func (versionDB *VersionEntity) semVer() (semanticVersion, bool) {
+	for _, s := range []string{versionDB.SemanticVersion, versionDB.VersionText} {
+		if semVer, err := parseSemanticVersion(s); err == nil {
+			return semVer, true
+		}
+	}
+	return semanticVersion{}, false
+}
+
+// download returns the download of the version for the OS - the generic URL if there is
+// no platform specific download, false if the version is not available for the OS
+func (versionDB *VersionEntity) download(os string) (VersionDownload, bool) {
+	for _, download := range versionDB.Downloads {
+		if strings.EqualFold(download.OS, os) {
+			return download, true
+		}
+	}
+	if versionDB.URL != "" {
+		return VersionDownload{OS: os, URL: versionDB.URL}, true
+	}
+	return VersionDownload{}, false
+}
+
+// versionReleases maps the build numbers of the versions to their semantic versions
+type versionReleases map[int]string
+
+// loadVersionReleases returns the semantic versions of all versions which have one
+func loadVersionReleases(ctx context.Context) (versionReleases, error) {
+	releases := make(versionReleases)
+	it := datastore.NewQuery(versionDBEntity).Ancestor(versionEntityRootKey(ctx)).Run(ctx)
+	for {
+		var versionDB VersionEntity
+		_, err := it.Next(&versionDB)
+		if err == datastore.Done {
+			return releases, nil
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		if semVer, ok := versionDB.semVer(); ok {
+			releases[versionDB.Version] = semVer.String()
+		}
+	}
+}
+
+// release returns the normalized semantic version of a GC version string (e.g. telemetry) - a
+// build number (e.g. "3955") is looked up in the versions, other strings (e.g. "3.5 RC1") are parsed,
+// the string itself is returned if neither works
+func (releases versionReleases) release(gcVersion string) string {
+	gcVersion = strings.TrimSpace(gcVersion)
+	if build, err := strconv.Atoi(gcVersion); err == nil {
+		if release, ok := releases[build]; ok {
+			return release
+		}
+		return gcVersion
+	}
+	if semVer, err := parseSemanticVersion(gcVersion); err == nil {
+		return semVer.String()
+	}
+	return gcVersion
+}
+
 // versionEntityKey returns the key used for all versionEntity entries.
 func versionEntityRootKey(ctx context.Context) *datastore.Key {
 	return datastore.NewKey(ctx, versionDBEntity, versionDBEntityRootKey, 0, nil)
@@ -120,13 +237,20 @@ func insertVersion(request *restful.Request, response *restful.Response) {
 
 	version := new(VersionEntityPostAPIv1)
 	if err := request.ReadEntity(version); err != nil {
-		addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		addInvalidRequestError(response, "Request body not readable", err)
 		return
 	}
 
 	// No checks if the necessary fields are filed or not - since GoldenCheetah is
 	// the only consumer of the APIs - any checks/response are to support this use-case
 
+	if version.SemanticVersion != "" {
+		if _, err := parseSemanticVersion(version.SemanticVersion); err != nil {
+			addInvalidRequestError(response, "Invalid semanticVersion", err)
+			return
+		}
+	}
+
 	versionDB := new(VersionEntity)
 	mapAPItoDBVersion(version, versionDB)
 
@@ -134,12 +258,7 @@ func insertVersion(request *restful.Request, response *restful.Response) {
 	key := datastore.NewIncompleteKey(ctx, versionDBEntity, versionEntityRootKey(ctx))
 	key, err := datastore.Put(ctx, key, versionDB)
 	if err != nil {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
@@ -151,35 +270,43 @@ func insertVersion(request *restful.Request, response *restful.Response) {
 func getVersion(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
+	// the versions newer than a build number or a semantic version
 	var version int
+	var semVer *semanticVersion
 	var err error
 	if versionString := request.QueryParameter("version"); versionString != "" {
 		if version, err = strconv.Atoi(versionString); err != nil {
-			addPlainTextError(response, http.StatusBadRequest, fmt.Sprint(err.Error(), " - Version: No integer string"))
-			return
+			parsed, err := parseSemanticVersion(versionString)
+			if err != nil {
+				addInvalidRequestError(response, "Invalid version - neither a build number nor a semantic version", err)
+				return
+			}
+			version, semVer = 0, &parsed
 		}
 	}
 
 	q := datastore.NewQuery(versionDBEntity).Filter("Version >", version).Order("-Version")
 
-	var versionList VersionEntityGetAPIv1List
+	versionList := VersionEntityGetAPIv1List{} // an empty list (not null) if there is no newer version
 
 	var versionOnDBList []VersionEntity
 	k, err := q.GetAll(ctx, &versionOnDBList)
 	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
-		}
+		commonResponseErrorProcessing(response, err)
 		return
 	}
 
 	// DB Entity needs to be mapped back
+	languages := acceptedLanguages(request.HeaderParameter(acceptLanguageHeader))
 	for i, versionDB := range versionOnDBList {
+		// semantic versions are not indexed - versions without one can't be compared
+		if semVer != nil {
+			if dbSemVer, ok := versionDB.semVer(); !ok || compareSemanticVersions(dbSemVer, *semVer) <= 0 {
+				continue
+			}
+		}
 		var versionAPI VersionEntityGetAPIv1
-		mapDBtoAPIVersion(&versionDB, &versionAPI)
+		mapDBtoAPIVersion(&versionDB, &versionAPI, languages)
 		versionAPI.Id = k[i].IntID()
 		versionList = append(versionList, versionAPI)
 	}
@@ -190,27 +317,54 @@ func getVersion(request *restful.Request, response *restful.Response) {
 func getLatestVersion(request *restful.Request, response *restful.Response) {
 	ctx := appengine.NewContext(request.Request)
 
-	var versionAPI VersionEntityGetAPIv1
-
-	q := datastore.NewQuery(versionDBEntity).Order("-Version").Limit(1)
+	// without channel every release type is applicable (as before channels were introduced)
+	maxType := Version_Development_Build
+	if channel := request.QueryParameter("channel"); channel != "" {
+		if maxType = versionTypesOfChannel(channel); maxType == 0 {
+			addInvalidRequestError(response, "Invalid channel - must be 'release', 'rc' or 'development'", nil)
+			return
+		}
+	}
+	os := request.QueryParameter("os")
+
+	// release type and platform are not indexed - newest first until the first applicable version
+	it := datastore.NewQuery(versionDBEntity).Order("-Version").Run(ctx)
+	for {
+		var versionDB VersionEntity
+		key, err := it.Next(&versionDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		if versionDB.Type > maxType {
+			continue
+		}
+		var download VersionDownload
+		if os != "" {
+			var ok bool
+			if download, ok = versionDB.download(os); !ok {
+				continue
+			}
+		}
 
-	var versionOnDBList []VersionEntity
-	k, err := q.GetAll(ctx, &versionOnDBList)
-	if err != nil && !isErrFieldMismatch(err) {
-		if appengine.IsOverQuota(err) {
-			// return 503 and a text similar to what GAE is returning as well
-			addPlainTextError(response, http.StatusServiceUnavailable, "503 - Over Quota")
-		} else {
-			addPlainTextError(response, http.StatusInternalServerError, err.Error())
+		// DB Entity needs to be mapped back
+		var versionAPI VersionEntityGetAPIv1
+		mapDBtoAPIVersion(&versionDB, &versionAPI, acceptedLanguages(request.HeaderParameter(acceptLanguageHeader)))
+		versionAPI.Id = key.IntID()
+		if os != "" {
+			versionAPI.URL = download.URL
+			versionAPI.Checksum = download.Checksum
 		}
+
+		response.WriteHeaderAndEntity(http.StatusOK, versionAPI)
 		return
 	}
 
-	// DB Entity needs to be mapped back
-	mapDBtoAPIVersion(&versionOnDBList[0], &versionAPI)
-	versionAPI.Id = k[0].IntID()
-
-	response.WriteHeaderAndEntity(http.StatusOK, versionAPI)
+	// nothing released yet (e.g. a fresh installation) or nothing for the channel/OS
+	addErrorResponse(response, http.StatusNotFound, errorCode_NotFound, "No version available", "")
 }
 
 
@@ -0,0 +1,319 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // register JPEG for image.Decode/DecodeConfig
+	"image/png"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Validation and thumbnail generation for GChart images
+// ---------------------------------------------------------------------------------------------------------------//
+
+// no picture bigger than 1000k please since Appengine
+// datastore api V3 only supports calls up to 1536 KB
+const maxImageSize = 1024000
+
+// images are decoded for the thumbnail, a small file may still declare huge
+// dimensions (decompression bomb) - so the number of pixels is limited as well
+const maxImagePixels = 4096 * 4096
+
+// thumbnails are scaled down to fit into this box (aspect ratio is kept)
+const thumbnailMaxWidth = 320
+const thumbnailMaxHeight = 240
+
+const (
+	imageType_PNG  = "image/png"
+	imageType_JPEG = "image/jpeg"
+)
+
+// imageRejectedError is returned if an uploaded image can not be accepted,
+// it's mapped to an explicit "image_rejected" error in the response
+type imageRejectedError struct {
+	httpStatus int
+	reason     string
+	err        error
+}
+
+func (e *imageRejectedError) Error() string {
+	if e.err != nil {
+		return fmt.Sprint(e.reason, ": ", e.err.Error())
+	}
+	return e.reason
+}
+
+// validateImage checks size and format of the image and returns its content type
+func validateImage(data []byte) (string, error) {
+	if len(data) > maxImageSize {
+		return "", &imageRejectedError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Image exceeds the maximum size of %d bytes", maxImageSize), nil}
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", &imageRejectedError{http.StatusBadRequest, "Image format not supported - only PNG and JPEG are accepted", err}
+	}
+	if err := checkImageDimensions(config); err != nil {
+		return "", err
+	}
+	switch format {
+	case "png":
+		return imageType_PNG, nil
+	case "jpeg":
+		return imageType_JPEG, nil
+	}
+	return "", &imageRejectedError{http.StatusBadRequest, "Image format not supported - only PNG and JPEG are accepted", nil}
+}
+
+// checkImageDimensions rejects images which are too large to be decoded
+func checkImageDimensions(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 {
+		return &imageRejectedError{http.StatusBadRequest, "Image has no pixels", nil}
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return &imageRejectedError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Image exceeds the maximum of %d pixels", maxImagePixels), nil}
+	}
+	return nil
+}
+
+// createThumbnail scales the image down (box filter) and returns it PNG encoded
+func createThumbnail(data []byte) ([]byte, error) {
+	// images stored before the validation are checked here before decoding them
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageDimensions(config); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	pixel := pixelReader(src)
+
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth == 0 || srcHeight == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+
+	// keep the aspect ratio, never scale up
+	width, height := srcWidth, srcHeight
+	if width > thumbnailMaxWidth {
+		height = height * thumbnailMaxWidth / width
+		width = thumbnailMaxWidth
+	}
+	if height > thumbnailMaxHeight {
+		width = width * thumbnailMaxHeight / height
+		height = thumbnailMaxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := bounds.Min.Y + (y+1)*srcHeight/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := bounds.Min.X + (x+1)*srcWidth/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := pixel(sx, sy)
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pixelReader returns a function which reads the (alpha-premultiplied, 16 bit) color
+// of a pixel - PNG and JPEG decode to these types, so the pixel data is accessed directly
+// instead of allocating a color.Color per pixel through At()
+func pixelReader(src image.Image) func(x, y int) (uint32, uint32, uint32, uint32) {
+	switch img := src.(type) {
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			return uint32(p[0]) * 0x101, uint32(p[1]) * 0x101, uint32(p[2]) * 0x101, uint32(p[3]) * 0x101
+		}
+	case *image.NRGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := uint32(p[3]) * 0x101
+			return uint32(p[0]) * 0x101 * a / 0xffff, uint32(p[1]) * 0x101 * a / 0xffff, uint32(p[2]) * 0x101 * a / 0xffff, a
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			r, g, b := color.YCbCrToRGB(img.Y[img.YOffset(x, y)], img.Cb[img.COffset(x, y)], img.Cr[img.COffset(x, y)])
+			return uint32(r) * 0x101, uint32(g) * 0x101, uint32(b) * 0x101, 0xffff
+		}
+	case *image.Paletted:
+		palette := make([][4]uint32, len(img.Palette))
+		for i, c := range img.Palette {
+			palette[i][0], palette[i][1], palette[i][2], palette[i][3] = c.RGBA()
+		}
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			idx := int(img.Pix[img.PixOffset(x, y)])
+			if idx >= len(palette) {
+				return 0, 0, 0, 0xffff
+			}
+			c := palette[idx]
+			return c[0], c[1], c[2], c[3]
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)]) * 0x101
+			return v, v, v, 0xffff
+		}
+	}
+	return func(x, y int) (uint32, uint32, uint32, uint32) {
+		return src.At(x, y).RGBA()
+	}
+}
+
+// imageContentType returns the stored type or detects it for images stored
+// before the type was recorded
+func imageContentType(imageType string, data []byte) string {
+	if imageType != "" {
+		return imageType
+	}
+	return http.DetectContentType(data)
+}
+
+// imageETag returns a strong entity tag for the image content
+func imageETag(data []byte) string {
+	sum := sha1.Sum(data)
+	return fmt.Sprint("\"", hex.EncodeToString(sum[:]), "\"")
+}
+
+// ------------------- blob storage of images ------------------------------------------------
+
+// images are stored in the blob store by chart id, an update simply overwrites them
+func gchartImageBlobName(key *datastore.Key) string {
+	return fmt.Sprintf("gchart/%d/image", key.IntID())
+}
+
+func gchartThumbnailBlobName(key *datastore.Key) string {
+	return fmt.Sprintf("gchart/%d/thumbnail", key.IntID())
+}
+
+// storeGChartImages moves image and thumbnail from the entity to the blob store
+// and keeps only the references in the entity
+func storeGChartImages(ctx context.Context, key *datastore.Key, chartDB *GChartEntity) error {
+	store := getBlobStore()
+
+	if len(chartDB.Image) == 0 {
+		// no image (anymore) - remove what might be left from a previous version
+		deleteGChartImages(ctx, key, chartDB)
+		return nil
+	}
+
+	name := gchartImageBlobName(key)
+	if err := store.Put(ctx, name, imageContentType(chartDB.ImageType, chartDB.Image), chartDB.Image); err != nil {
+		return err
+	}
+	chartDB.ImageRef = name
+	chartDB.Image = nil
+
+	name = gchartThumbnailBlobName(key)
+	if len(chartDB.Thumbnail) == 0 {
+		store.Delete(ctx, name) // ignore errors
+		chartDB.ThumbnailRef = ""
+		return nil
+	}
+	if err := store.Put(ctx, name, imageType_PNG, chartDB.Thumbnail); err != nil {
+		return err
+	}
+	chartDB.ThumbnailRef = name
+	chartDB.Thumbnail = nil
+
+	return nil
+}
+
+// loadGChartImages reads image and/or thumbnail referenced by the entity from the blob store,
+// entities which still have their images inline are not changed
+func loadGChartImages(ctx context.Context, chartDB *GChartEntity, withImage bool, withThumbnail bool) error {
+	store := getBlobStore()
+
+	// without a stored thumbnail, the image is needed to create one
+	if withThumbnail && chartDB.ThumbnailRef == "" {
+		withImage = true
+	}
+
+	if withImage && chartDB.ImageRef != "" {
+		data, err := store.Get(ctx, chartDB.ImageRef)
+		if err != nil {
+			return err
+		}
+		chartDB.Image = data
+	}
+	if withThumbnail && chartDB.ThumbnailRef != "" {
+		data, err := store.Get(ctx, chartDB.ThumbnailRef)
+		if err != nil {
+			return err
+		}
+		chartDB.Thumbnail = data
+	}
+	return nil
+}
+
+// deleteGChartImages removes image and thumbnail from the blob store (errors are ignored)
+func deleteGChartImages(ctx context.Context, key *datastore.Key, chartDB *GChartEntity) {
+	store := getBlobStore()
+	store.Delete(ctx, gchartImageBlobName(key))
+	store.Delete(ctx, gchartThumbnailBlobName(key))
+	chartDB.ImageRef = ""
+	chartDB.ThumbnailRef = ""
+}
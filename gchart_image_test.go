@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngWithSize returns a small PNG whose header declares the given dimensions
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	data := encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+	// signature (8), IHDR length (4), "IHDR" (4), width (4), height (4), ... crc
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestValidateImage(t *testing.T) {
+	small := image.NewRGBA(image.Rect(0, 0, 20, 10))
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantType   string
+		wantStatus int
+	}{
+		{"png", encodePNG(t, small), imageType_PNG, 0},
+		{"jpeg", encodeJPEG(t, small), imageType_JPEG, 0},
+		{"garbage", []byte("not an image"), "", http.StatusBadRequest},
+		{"empty", nil, "", http.StatusBadRequest},
+		{"too many bytes", make([]byte, maxImageSize+1), "", http.StatusRequestEntityTooLarge},
+		{"max pixels", pngWithSize(t, 4096, 4096), imageType_PNG, 0},
+		{"decompression bomb", pngWithSize(t, 30000, 30000), "", http.StatusRequestEntityTooLarge},
+		{"too wide", pngWithSize(t, maxImagePixels+1, 1), "", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageType, err := validateImage(tt.data)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if imageType != tt.wantType {
+					t.Errorf("type = %q, want %q", imageType, tt.wantType)
+				}
+				return
+			}
+			rejected, ok := err.(*imageRejectedError)
+			if !ok {
+				t.Fatalf("error = %v, want *imageRejectedError", err)
+			}
+			if rejected.httpStatus != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rejected.httpStatus, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCreateThumbnail(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 640, 480))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = 0xff
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 100, 1000))
+	paletted := image.NewPaletted(image.Rect(0, 0, 50, 50), color.Palette{color.Black, color.White})
+	gray := image.NewGray(image.Rect(0, 0, 1000, 10))
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"rgba", encodePNG(t, rgba), 320, 240},
+		{"ycbcr", encodeJPEG(t, rgba), 320, 240},
+		{"nrgba portrait", encodePNG(t, nrgba), 24, 240},
+		{"paletted not scaled up", encodePNG(t, paletted), 50, 50},
+		{"gray landscape", encodePNG(t, gray), 320, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thumbnail, err := createThumbnail(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			img, err := png.Decode(bytes.NewReader(thumbnail))
+			if err != nil {
+				t.Fatalf("thumbnail is no PNG: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Errorf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+		})
+	}
+
+	// the white RGBA image stays white
+	thumbnail, _ := createThumbnail(encodePNG(t, rgba))
+	img, _ := png.Decode(bytes.NewReader(thumbnail))
+	if r, g, b, a := img.At(10, 10).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+		t.Errorf("color = %x %x %x %x, want white", r, g, b, a)
+	}
+
+	if _, err := createThumbnail(pngWithSize(t, 30000, 30000)); err == nil {
+		t.Errorf("decompression bomb is not rejected")
+	}
+}
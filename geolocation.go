@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Geolocation of the caller (for telemetry) - App Engine headers, a local MaxMind DB file or none
+// ---------------------------------------------------------------------------------------------------------------//
+
+// GeoLocation uses the format of the App Engine headers (e.g. "DE", "by", "munich", "48.137154,11.576124")
+type GeoLocation struct {
+	Country     string
+	Region      string
+	City        string
+	CityLatLong string
+}
+
+// GeoLocator determines the location of the caller of a request
+type GeoLocator interface {
+	Locate(ctx context.Context, r *http.Request) GeoLocation
+}
+
+// configuration (see app.yaml)
+const geoLocatorConfig = "Geo_Locator"                // "appengine" (default), "maxmind" or "none"
+const geoDatabaseConfig = "Geo_Database"              // MaxMind DB file for "maxmind"
+const geoTrustedProxiesConfig = "Geo_Trusted_Proxies" // addresses/CIDRs of the proxies in front of a self-hosted server
+
+const (
+	geoLocator_AppEngine = "appengine"
+	geoLocator_MaxMind   = "maxmind"
+	geoLocator_None      = "none"
+)
+
+var geoLocator GeoLocator
+var geoLocatorOnce sync.Once
+
+// getGeoLocator returns the configured geolocation provider
+func getGeoLocator() GeoLocator {
+	geoLocatorOnce.Do(func() {
+		switch os.Getenv(geoLocatorConfig) {
+		case geoLocator_MaxMind:
+			geoLocator = &maxMindGeoLocator{path: os.Getenv(geoDatabaseConfig), proxies: os.Getenv(geoTrustedProxiesConfig)}
+		case geoLocator_None:
+			geoLocator = noneGeoLocator{}
+		default:
+			geoLocator = appEngineGeoLocator{}
+		}
+	})
+	return geoLocator
+}
+
+// ------------------- App Engine request headers ------------------------------------------
+
+type appEngineGeoLocator struct{}
+
+func (appEngineGeoLocator) Locate(ctx context.Context, r *http.Request) GeoLocation {
+	return GeoLocation{
+		Country:     r.Header.Get("X-AppEngine-Country"),
+		Region:      r.Header.Get("X-AppEngine-Region"),
+		City:        r.Header.Get("X-AppEngine-City"),
+		CityLatLong: r.Header.Get("X-AppEngine-CityLatLong"),
+	}
+}
+
+// ------------------- no location ---------------------------------------------------------
+
+type noneGeoLocator struct{}
+
+func (noneGeoLocator) Locate(ctx context.Context, r *http.Request) GeoLocation {
+	return GeoLocation{}
+}
+
+// ------------------- local MaxMind DB file (self-hosting) --------------------------------
+
+type maxMindGeoLocator struct {
+	path           string
+	proxies        string
+	once           sync.Once
+	reader         *mmdbReader
+	trustedProxies []*net.IPNet
+}
+
+func (l *maxMindGeoLocator) Locate(ctx context.Context, r *http.Request) GeoLocation {
+	l.once.Do(func() {
+		var err error
+		l.trustedProxies, err = parseTrustedProxies(l.proxies)
+		if err != nil {
+			// X-Forwarded-For is only used behind the valid ones
+			log.Errorf(ctx, "Invalid %s: %v", geoTrustedProxiesConfig, err)
+		}
+		reader, err := openMmdb(l.path)
+		if err != nil {
+			// no location instead of failing every telemetry call
+			log.Errorf(ctx, "Reading MaxMind DB %q failed: %v", l.path, err)
+			return
+		}
+		l.reader = reader
+	})
+	if l.reader == nil {
+		return GeoLocation{}
+	}
+
+	ip := clientIP(r, l.trustedProxies)
+	if ip == nil {
+		return GeoLocation{}
+	}
+	record, err := l.reader.lookup(ip)
+	if err != nil {
+		log.Warningf(ctx, "MaxMind DB lookup failed: %v", err)
+		return GeoLocation{}
+	}
+
+	var location GeoLocation
+	location.Country = mmdbString(record, "country", "iso_code")
+	location.Region = strings.ToLower(mmdbString(record, "subdivisions", 0, "iso_code"))
+	location.City = strings.ToLower(mmdbString(record, "city", "names", "en"))
+	latitude, okLatitude := mmdbPath(record, "location", "latitude").(float64)
+	longitude, okLongitude := mmdbPath(record, "location", "longitude").(float64)
+	if okLatitude && okLongitude {
+		location.CityLatLong = fmt.Sprintf("%f,%f", latitude, longitude)
+	}
+	return location
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For can be set by the caller, so
+// it's only used if the request comes from a trusted proxy - the entries are walked from the
+// right (added by the proxies) to the first one which is not a trusted proxy. On App Engine
+// no proxy is trusted, the remote address is the caller there.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	var hops []string
+	for _, forwarded := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(forwarded, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && ip != nil && isTrustedProxy(ip, trustedProxies); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// not written by a proxy - the last trusted one is the best known caller
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads the comma separated addresses or CIDRs - invalid entries are
+// skipped and reported in the error
+func parseTrustedProxies(config string) ([]*net.IPNet, error) {
+	var trustedProxies []*net.IPNet
+	var invalid []string
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip = ip.To4()
+					bits = 8 * net.IPv4len
+				}
+				trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, network, err := net.ParseCIDR(entry); err == nil {
+			trustedProxies = append(trustedProxies, network)
+			continue
+		}
+		invalid = append(invalid, entry)
+	}
+	if len(invalid) > 0 {
+		return trustedProxies, fmt.Errorf("invalid entries %q", invalid)
+	}
+	return trustedProxies, nil
+}
+
+// mmdbPath walks the record along map keys (string) and array indexes (int)
+func mmdbPath(value interface{}, path ...interface{}) interface{} {
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = m[s]
+		case int:
+			a, ok := value.([]interface{})
+			if !ok || s >= len(a) {
+				return nil
+			}
+			value = a[s]
+		}
+	}
+	return value
+}
+
+func mmdbString(value interface{}, path ...interface{}) string {
+	s, _ := mmdbPath(value, path...).(string)
+	return s
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies(" 10.0.0.0/8, 192.168.1.1 ,,::1, proxy, 300.1.1.1/8")
+	if err == nil {
+		t.Errorf("parseTrustedProxies() error = nil, want the invalid entries")
+	}
+	if len(trustedProxies) != 3 {
+		t.Fatalf("parseTrustedProxies() = %v, want 3 networks", trustedProxies)
+	}
+	for _, test := range []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", true},
+		{"11.0.0.1", false},
+	} {
+		if got := isTrustedProxy(net.ParseIP(test.ip), trustedProxies); got != test.want {
+			t.Errorf("isTrustedProxy(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+
+	if trustedProxies, err := parseTrustedProxies(""); err != nil || len(trustedProxies) != 0 {
+		t.Errorf("parseTrustedProxies(\"\") = %v, %v, want none", trustedProxies, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		proxies    []*net.IPNet
+		want       string
+	}{
+		{"no proxy", "1.2.3.4:5678", nil, trustedProxies, "1.2.3.4"},
+		{"remote address without port", "1.2.3.4", nil, trustedProxies, "1.2.3.4"},
+		{"forwarded by an untrusted caller", "1.2.3.4:5678", []string{"5.6.7.8"}, trustedProxies, "1.2.3.4"},
+		{"no trusted proxies configured", "10.0.0.1:5678", []string{"5.6.7.8"}, nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:5678", []string{"5.6.7.8"}, trustedProxies, "5.6.7.8"},
+		{"spoofed first entry", "10.0.0.1:5678", []string{"9.9.9.9, 5.6.7.8"}, trustedProxies, "5.6.7.8"},
+		{"chain of trusted proxies", "10.0.0.1:5678", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, trustedProxies, "5.6.7.8"},
+		{"several headers", "10.0.0.1:5678", []string{"9.9.9.9", "5.6.7.8, 10.0.0.2"}, trustedProxies, "5.6.7.8"},
+		{"invalid entry", "10.0.0.1:5678", []string{"5.6.7.8, unknown, 10.0.0.2"}, trustedProxies, "10.0.0.2"},
+		{"only trusted proxies", "10.0.0.1:5678", []string{"10.0.0.3, 10.0.0.2"}, trustedProxies, "10.0.0.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := clientIP(r, test.proxies); !got.Equal(net.ParseIP(test.want)) {
+				t.Errorf("clientIP() = %v, want %s", got, test.want)
+			}
+		})
+	}
+}
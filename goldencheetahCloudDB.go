@@ -18,9 +18,14 @@
 package main
 
 import (
+	"crypto/subtle"
+	b64 "encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"google.golang.org/appengine"
 
@@ -36,6 +41,10 @@ func main() {
 // init the Webserver within the GAE framework
 func init() {
 
+	// gzip/deflate responses if the client accepts it (compressed requests are
+	// handled by ReadEntity based on the Content-Encoding header)
+	restful.DefaultContainer.EnableContentEncoding(true)
+
 	ws := new(restful.WebService)
 
 	// ----------------------------------------------------------------------------------
@@ -47,25 +56,42 @@ func init() {
 	Consumes(restful.MIME_JSON).
 	Produces(restful.MIME_JSON) // you can specify this per route as well
 
+	// every response carries the request id - see "api_error.go"
+	ws.Filter(requestIdFilter)
+
 	ws.Route(ws.POST("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertGChart).
 	// docs
 	Doc("creates a gchart").
 	Operation("createGChart").
+	Param(ws.QueryParameter("duplicate", "'flag' (default) or 'reject' an upload with identical content").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "secret of the creator - bound to the profile if the upload creates it").DataType("string")).
 	Reads(GChartPostAPIv1{})) // from the request
 
 	ws.Route(ws.PUT("/gchart/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateGChart).
 	// docs
 	Doc("updates a gchart").
 	Operation("updatedGChart").
+	Param(ws.HeaderParameter(creatorSecretHeader, "secret of the creator - bound to the profile if the upload creates it").DataType("string")).
 	Reads(GChartPostAPIv1{})) // from the request
 
-	ws.Route(ws.GET("/gchart/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartById).
+	ws.Route(ws.GET("/gchart/{id}").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(getGChartById).
 	// docs
 	Doc("get a gchart").
 	Operation("getGChartbyId").
 	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("image", "'full' (default), 'thumbnail' or 'none'").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "the creator email is returned to curators of the gchart").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "the creator email is returned to the creator (or an admin)").DataType("string")).
 	Writes(GChartGetAPIv1{})) // on the response
 
+	ws.Route(ws.GET("/gchart/{id}/image").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartImageById).
+	// docs
+	Doc("get the image of a gchart as binary (PNG or JPEG)").
+	Operation("getGChartImagebyId").
+	Produces("image/png", "image/jpeg").
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Param(ws.QueryParameter("thumbnail", "true/false return the thumbnail instead of the full image").DataType("bool")))
+
 	ws.Route(ws.PUT("/gchartuse/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(incrementGChartUsageById).
 	// docs
 	Doc("increments the DL use counter for a chart by 1").
@@ -83,7 +109,49 @@ func init() {
 	Doc("set the curation status of the gchart to {newStatus} which must be 'true' or 'false' ").
 	Operation("updateGChartCurationStatus").
 	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
-	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")))
+	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")).
+	Param(ws.QueryParameter("curatorId", "CuratorId of the reviewing curator - must be allowed to curate the artifact kind/sport").DataType("string")))
+
+	ws.Route(ws.PUT("/gchartreview/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(reviewGChartById).
+	// docs
+	Doc("approve or reject the gchart - a reason is mandatory for reject").
+	Operation("reviewGChart").
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Reads(CurationReviewAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/gchartcuration/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartCurationById).
+	// docs
+	Doc("get the curation state of the gchart incl. reason and reviewing curator").
+	Operation("getGChartCurationById").
+	Param(ws.PathParameter("id", "identifier of the gchart").DataType("string")).
+	Writes(CurationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/gchartcurationqueue").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartCurationQueue).
+	// docs
+	Doc("gets the headers of all gcharts waiting for review - oldest first").
+	Operation("getGChartCurationQueue").
+	Writes(GChartAPIv1HeaderOnlyList{})) // on the response
+
+	ws.Route(ws.PUT("/gchartimagemigration").Filter(adminAuthenticate).To(migrateGChartImages).
+	// docs
+	Doc("moves inline images of a bucket of gcharts to the blob store - repeat with the returned cursor until it's empty").
+	Operation("migrateGChartImages").
+	Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+	Writes(GChartImageMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/gchartcontenthashmigration").Filter(adminAuthenticate).To(migrateGChartContentHashes).
+	// docs
+	Doc("stores the content hash of a bucket of gcharts stored before it was introduced - repeat with the returned cursor until it's empty").
+	Operation("migrateGChartContentHashes").
+	Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+	Writes(ContentHashMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/gchartduplicates").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartDuplicates).
+	// docs
+	Doc("gets groups of gcharts which are possibly duplicates (same content or same name) - for curators").
+	Operation("getGChartDuplicates").
+	Param(ws.QueryParameter("curatorId", "CuratorId of the requesting curator - must be allowed to curate gcharts").DataType("string")).
+	Writes(DuplicateGroupAPIv1List{})) // on the response
 
 	// Endpoint for GChartHeader only (no JPG or Definition)
 	ws.Route(ws.GET("/gchartheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeader).
@@ -114,19 +182,24 @@ func init() {
 	// docs
 	Doc("creates a usermetric").
 	Operation("createUserMetric").
+	Param(ws.QueryParameter("duplicate", "'flag' (default) or 'reject' an upload with identical content").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "secret of the creator - bound to the profile if the upload creates it").DataType("string")).
 	Reads(UserMetricAPIv1{})) // from the request
 
 	ws.Route(ws.PUT("/usermetric/").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(updateUserMetric).
 	// docs
 	Doc("updates a usermetric").
 	Operation("updateUserMetric").
+	Param(ws.HeaderParameter(creatorSecretHeader, "secret of the creator - bound to the profile if the upload creates it").DataType("string")).
 	Reads(UserMetricAPIv1{})) // from the request
 
-	ws.Route(ws.GET("/usermetric/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricById).
+	ws.Route(ws.GET("/usermetric/{id}").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricById).
 	// docs
 	Doc("get a usermetric").
 	Operation("getUserMetricbyId").
 	Param(ws.PathParameter("id", "identifier of the user metric").DataType("string")).
+	Param(ws.QueryParameter("curatorId", "the creator email is returned to curators of the usermetric").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "the creator email is returned to the creator (or an admin)").DataType("string")).
 	Writes(UserMetricAPIv1{})) // on the response
 
 	ws.Route(ws.DELETE("/usermetric/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteUserMetricById).
@@ -140,7 +213,42 @@ func init() {
 	Doc("set the curation status of the usermetric to {newStatus} which must be 'true' or 'false' ").
 	Operation("updateUserMetricCurationStatus").
 	Param(ws.PathParameter("id", "identifier of the usermetric").DataType("string")).
-	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")))
+	Param(ws.QueryParameter("newStatus", "true/false curation status").DataType("bool")).
+	Param(ws.QueryParameter("curatorId", "CuratorId of the reviewing curator - must be allowed to curate the artifact kind/sport").DataType("string")))
+
+	ws.Route(ws.PUT("/usermetricreview/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(reviewUserMetricById).
+	// docs
+	Doc("approve or reject the usermetric - a reason is mandatory for reject").
+	Operation("reviewUserMetric").
+	Param(ws.PathParameter("id", "identifier of the usermetric").DataType("string")).
+	Reads(CurationReviewAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/usermetriccuration/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricCurationById).
+	// docs
+	Doc("get the curation state of the usermetric incl. reason and reviewing curator").
+	Operation("getUserMetricCurationById").
+	Param(ws.PathParameter("id", "identifier of the usermetric").DataType("string")).
+	Writes(CurationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/usermetriccurationqueue").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricCurationQueue).
+	// docs
+	Doc("gets the headers of all usermetrics waiting for review - oldest first").
+	Operation("getUserMetricCurationQueue").
+	Writes(UserMetricAPIv1HeaderOnlyList{})) // on the response
+
+	ws.Route(ws.PUT("/usermetriccontenthashmigration").Filter(adminAuthenticate).To(migrateUserMetricContentHashes).
+	// docs
+	Doc("stores the content hash of a bucket of usermetrics stored before it was introduced - repeat with the returned cursor until it's empty").
+	Operation("migrateUserMetricContentHashes").
+	Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+	Writes(ContentHashMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/usermetricduplicates").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricDuplicates).
+	// docs
+	Doc("gets groups of usermetrics which are possibly duplicates (same content or same name) - for curators").
+	Operation("getUserMetricDuplicates").
+	Param(ws.QueryParameter("curatorId", "CuratorId of the requesting curator - must be allowed to curate usermetrics").DataType("string")).
+	Writes(DuplicateGroupAPIv1List{})) // on the response
 
 	// Endpoint for Header only
 	ws.Route(ws.GET("/usermetricheader").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeader).
@@ -160,26 +268,176 @@ func init() {
 	// ----------------------------------------------------------------------------------
 	// setup the curator endpoints - processing see "entity_curator.go"
 	// ----------------------------------------------------------------------------------
-	ws.Route(ws.GET("/curator").Filter(basicAuthenticate).To(getCurator).
+	ws.Route(ws.GET("/curator").Filter(basicOrAdminAuthenticate).To(getCurator).
 	// docs
-	Doc("gets a collection of curators").
+	Doc("gets a collection of curators - emails are only returned to admins").
 	Operation("getCurator").
 	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Param(ws.QueryParameter("role", "'curator' or 'admin'").DataType("string")).
 	Writes(CuratorAPIv1List{})) // on the response
 
-	ws.Route(ws.POST("/curator").Filter(basicAuthenticate).To(insertCurator).
+	ws.Route(ws.POST("/curator").Filter(adminAuthenticate).To(insertCurator).
 	// docs
-	Doc("creates a curator").
+	Doc("creates a curator - the CuratorId must be unique (admin only)").
 	Operation("createCurator").
 	Reads(CuratorAPIv1{})) // from the request
 
+	ws.Route(ws.PUT("/curator/{id}").Filter(adminAuthenticate).To(updateCurator).
+	// docs
+	Doc("updates a curator - the CuratorId must be unique (admin only)").
+	Operation("updateCurator").
+	Param(ws.PathParameter("id", "identifier of the curator").DataType("string")).
+	Reads(CuratorAPIv1{})) // from the request
+
+	ws.Route(ws.DELETE("/curator/{id}").Filter(adminAuthenticate).To(deleteCurator).
+	// docs
+	Doc("removes a curator (admin only)").
+	Operation("deleteCurator").
+	Param(ws.PathParameter("id", "identifier of the curator").DataType("string")))
+
+	ws.Route(ws.PUT("/curatormigration").Filter(adminAuthenticate).To(migrateCurators).
+	// docs
+	Doc("merges curators stored with the same CuratorId before it was unique into one, curators with different scopes are reported as conflicts (admin only)").
+	Operation("migrateCurators").
+	Writes(CuratorMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/curatoraudit").Filter(adminAuthenticate).To(getCuratorAudit).
+	// docs
+	Doc("gets the audit trail of curator changes - newest first (admin only)").
+	Operation("getCuratorAudit").
+	Param(ws.QueryParameter("curatorId", "UUid of the Curator").DataType("string")).
+	Writes(CuratorAuditAPIv1List{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the abuse report endpoints - processing see "entity_report.go"
+	// ----------------------------------------------------------------------------------
+
+	ws.Route(ws.POST("/report").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertReport).
+	// docs
+	Doc("reports an offensive or broken gchart/usermetric - the artifact is hidden after a threshold of distinct reporters, the reporter must have a creator profile").
+	Operation("createReport").
+	Reads(ReportPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/report").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getReport).
+	// docs
+	Doc("gets a collection of reports of artifacts the curator is allowed to curate - oldest first, paged, continue with the cursor returned in the X-Cursor header").
+	Operation("getReport").
+	Param(ws.QueryParameter("curatorId", "CuratorId of the requesting curator").DataType("string")).
+	Param(ws.QueryParameter("status", "'open' (default) or 'resolved'").DataType("string")).
+	Param(ws.QueryParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.QueryParameter("limit", "maximum number of reports read for the page (default 100, max 1000)").DataType("integer")).
+	Param(ws.QueryParameter("cursor", "cursor returned in the X-Cursor header of the previous page").DataType("string")).
+	Writes(ReportGetAPIv1List{})) // on the response
+
+	ws.Route(ws.PUT("/report/resolve").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(resolveReport).
+	// docs
+	Doc("closes all open reports of an artifact and restores it or keeps it hidden").
+	Operation("resolveReport").
+	Reads(ReportResolveAPIv1{})) // from the request
+
+	// ----------------------------------------------------------------------------------
+	// setup the creator profile endpoints - processing see "entity_creator.go"
+	// ----------------------------------------------------------------------------------
+
+	ws.Route(ws.PUT("/creator/{creatorId}").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(upsertCreator).
+	// docs
+	Doc("creates or updates the profile (nickname, email, avatar) of a creator - only the creator (secret bound when the profile was created) or an admin may change it").
+	Operation("upsertCreator").
+	Param(ws.PathParameter("creatorId", "CreatorId of the profile").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "secret of the creator - bound if the PUT creates the profile, profiles without a secret are changed by an admin only").DataType("string")).
+	Reads(CreatorAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/creator/{creatorId}").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(getCreator).
+	// docs
+	Doc("gets the profile of a creator").
+	Operation("getCreator").
+	Param(ws.PathParameter("creatorId", "CreatorId of the profile").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "email is only returned to the creator (or an admin)").DataType("string")).
+	Writes(CreatorAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/creator/{creatorId}/export").Filter(adminAuthenticate).Filter(filterCloudDBStatus).To(exportCreatorData).
+	// docs
+	Doc("exports all data stored for a creator (charts, metrics, curator records, ratings, comments, reports) - admin only").
+	Operation("exportCreatorData").
+	Param(ws.PathParameter("creatorId", "CreatorId of the creator").DataType("string")).
+	Writes(CreatorExportAPIv1{})) // on the response
+
+	ws.Route(ws.DELETE("/creator/{creatorId}").Filter(adminAuthenticate).Filter(filterCloudDBStatus).To(eraseCreatorData).
+	// docs
+	Doc("erases all personal data of a creator - uploads are deleted, profile, curator records, ratings, comments and reports removed - admin only").
+	Operation("eraseCreatorData").
+	Param(ws.PathParameter("creatorId", "CreatorId of the creator").DataType("string")).
+	Writes(CreatorErasureAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/creator/{creatorId}/gchart").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(getGChartHeaderByCreator).
+	// docs
+	Doc("gets the headers of all gcharts of a creator - newest first").
+	Operation("getGChartHeaderByCreator").
+	Param(ws.PathParameter("creatorId", "CreatorId of the creator").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "deleted and hidden gcharts are included for the creator (or an admin)").DataType("string")).
+	Writes(GChartAPIv1HeaderOnlyList{})) // on the response
+
+	ws.Route(ws.GET("/creator/{creatorId}/usermetric").Filter(basicOrAdminAuthenticate).Filter(filterCloudDBStatus).To(getUserMetricHeaderByCreator).
+	// docs
+	Doc("gets the headers of all usermetrics of a creator - newest first").
+	Operation("getUserMetricHeaderByCreator").
+	Param(ws.PathParameter("creatorId", "CreatorId of the creator").DataType("string")).
+	Param(ws.HeaderParameter(creatorSecretHeader, "deleted and hidden usermetrics are included for the creator (or an admin)").DataType("string")).
+	Writes(UserMetricAPIv1HeaderOnlyList{})) // on the response
+
+	// ----------------------------------------------------------------------------------
+	// setup the rating and comment endpoints - processing see "entity_rating.go", "entity_comment.go"
+	// ----------------------------------------------------------------------------------
+
+	ws.Route(ws.PUT("/rating/{artifactKind}/{artifactId}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(upsertRating).
+	// docs
+	Doc("creates or updates the star rating (1..5) of a user for a gchart/usermetric").
+	Operation("upsertRating").
+	Param(ws.PathParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.PathParameter("artifactId", "identifier of the artifact").DataType("string")).
+	Reads(RatingPutAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/rating/{artifactKind}/{artifactId}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getRating).
+	// docs
+	Doc("gets the aggregated rating of a gchart/usermetric").
+	Operation("getRating").
+	Param(ws.PathParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.PathParameter("artifactId", "identifier of the artifact").DataType("string")).
+	Param(ws.QueryParameter("creatorId", "returns the own rating of this user in addition").DataType("string")).
+	Writes(RatingGetAPIv1{})) // on the response
+
+	ws.Route(ws.POST("/comment/{artifactKind}/{artifactId}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(insertComment).
+	// docs
+	Doc("creates a comment on a gchart/usermetric").
+	Operation("createComment").
+	Param(ws.PathParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.PathParameter("artifactId", "identifier of the artifact").DataType("string")).
+	Reads(CommentPostAPIv1{})) // from the request
+
+	ws.Route(ws.GET("/comment/{artifactKind}/{artifactId}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(getComment).
+	// docs
+	Doc("gets the comments of a gchart/usermetric - oldest first").
+	Operation("getComment").
+	Param(ws.PathParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.PathParameter("artifactId", "identifier of the artifact").DataType("string")).
+	Writes(CommentGetAPIv1List{})) // on the response
+
+	ws.Route(ws.DELETE("/comment/{artifactKind}/{artifactId}/{id}").Filter(basicAuthenticate).Filter(filterCloudDBStatus).To(deleteComment).
+	// docs
+	Doc("deletes a comment (soft delete) - allowed for the author and curators").
+	Operation("deleteComment").
+	Param(ws.PathParameter("artifactKind", "'gchart' or 'usermetric'").DataType("string")).
+	Param(ws.PathParameter("artifactId", "identifier of the artifact").DataType("string")).
+	Param(ws.PathParameter("id", "identifier of the comment").DataType("string")).
+	Param(ws.QueryParameter("creatorId", "user deleting the comment").DataType("string")))
+
 	// ----------------------------------------------------------------------------------
 	// setup the status endpoints - processing see "entity_status.go"
 	// ----------------------------------------------------------------------------------
 
 	ws.Route(ws.POST("/status").Filter(basicAuthenticate).To(insertStatus).
 	// docs
-	Doc("creates a new status entity").
+	Doc("creates a new status entity - a changeDate in the future (and an endDate) announces a maintenance window, a partial failure can be limited to artifactKinds and operations").
 	Operation("createStatus").
 	Reads(StatusEntityPostAPIv1{})) // from the request
 
@@ -192,15 +450,16 @@ func init() {
 
 	ws.Route(ws.GET("/status/latest").Filter(basicAuthenticate).To(getCurrentStatus).
 	// docs
-	Doc("gets the current/latest status").
+	Doc("gets the current status (of the active window) and the upcoming windows").
 	Operation("getStatus").
 	Writes(StatusEntityGetAPIv1{})) // on the response
 
 	ws.Route(ws.GET("/statustext/{id}").Filter(basicAuthenticate).To(getStatusTextById).
 	// docs
-	Doc("gets the text for a specific status entity").
+	Doc("gets the text for a specific status entity - in the language requested by Accept-Language (fallback English)").
 	Operation("getStatusText").
 	Param(ws.PathParameter("id", "identifier of the version text").DataType("string")).
+	Param(ws.HeaderParameter("Accept-Language", "preferred languages of the text").DataType("string")).
 	Writes(StatusEntityGetTextAPIv1{})) // on the response
 
 	// ----------------------------------------------------------------------------------
@@ -215,15 +474,19 @@ func init() {
 
 	ws.Route(ws.GET("/version").Filter(basicAuthenticate).To(getVersion).
 	// docs
-		Doc("gets a collection of versions").
+		Doc("gets a collection of versions - texts in the language requested by Accept-Language (fallback English)").
 		Operation("getVersion").
-		Param(ws.QueryParameter("version", "Version").DataType("string")).
+		Param(ws.QueryParameter("version", "only newer versions than the build number (e.g. '3955') or the semantic version (e.g. '3.5.0-rc1')").DataType("string")).
+		Param(ws.HeaderParameter("Accept-Language", "preferred languages of the texts").DataType("string")).
 		Writes(VersionEntityGetAPIv1List{})) // on the response
 
 	ws.Route(ws.GET("/version/latest").Filter(basicAuthenticate).To(getLatestVersion).
 	// docs
-		Doc("gets the latest version").
+		Doc("gets the latest version of the channel which has a download for the OS - text in the language requested by Accept-Language (fallback English)").
 		Operation("getVersion").
+		Param(ws.QueryParameter("channel", "'release', 'rc' (incl. releases) or 'development' (all) - default all").DataType("string")).
+		Param(ws.QueryParameter("os", "platform of the download, e.g. 'windows', 'macos', 'linux' - downloadURL and checksum are the ones of the platform").DataType("string")).
+		Param(ws.HeaderParameter("Accept-Language", "preferred languages of the text").DataType("string")).
 		Writes(VersionEntityGetAPIv1{})) // on the response
 
 	// ----------------------------------------------------------------------------------
@@ -232,20 +495,99 @@ func init() {
 
 	ws.Route(ws.PUT("/telemetry").Filter(basicAuthenticate).To(upsertTelemetry).
 	// docs
-		Doc("stores location,... of the call based on IP adress").
+		Doc("queues location,... of the call based on IP adress - written asynchronously (202)").
 		Operation("post telemetry data").
 		Reads(TelemetryEntityPostAPIv1{})) // from the request
 
 	ws.Route(ws.GET("/telemetry").Filter(basicAuthenticate).To(getTelemetry).
 	// docs
-		Doc("gets a collection of versions").
+		Doc("gets a page of telemetry data matching all given filters - next page with the cursor from header X-Cursor, which is also set for pages ended early by the scan limit").
 		Operation("get All Telemetry Data").
+		Produces(restful.MIME_JSON, mimeTextCSV).
 		Param(ws.QueryParameter("createdAfter", "Telemetry created after").DataType("string")).
 		Param(ws.QueryParameter("updatedAfter", "Telemetry last updated after").DataType("string")).
 		Param(ws.QueryParameter("os", "Operating System").DataType("string")).
 		Param(ws.QueryParameter("version", "GoldenCheetah Version").DataType("string")).
+		Param(ws.QueryParameter("limit", "Page size - default 500, max. 5000").DataType("integer")).
+		Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+		Param(ws.QueryParameter("format", "'json' (default) or 'csv'").DataType("string")).
 		Writes(TelemetryEntityGetAPIv1List{})) // on the response
 
+	ws.Route(ws.DELETE("/telemetry/{key}").Filter(adminAuthenticate).To(deleteTelemetry).
+	// docs
+		Doc("deletes the telemetry data of a user key (opt-out) - admin only").
+		Operation("deleteTelemetry").
+		Param(ws.PathParameter("key", "user key of the telemetry data").DataType("string")))
+
+	// aggregates - processing see "telemetry_stats.go"
+	ws.Route(ws.GET("/telemetry/stats/installs").Filter(basicAuthenticate).To(getTelemetryInstalls).
+	// docs
+		Doc("gets the number of installs active in the time window by version, os or country - cached for an hour").
+		Operation("getTelemetryInstalls").
+		Param(ws.QueryParameter("groupBy", "'version' (default), 'release' (semantic version of the version, e.g. '3.5.0-rc1'), 'os' or 'country'").DataType("string")).
+		Param(ws.QueryParameter("activeAfter", "Used after (RFC3339) - default 30 days ago").DataType("string")).
+		Param(ws.QueryParameter("activeBefore", "End of the window (RFC3339) - installed before, counted with the version/os used then - default now").DataType("string")).
+		Writes(TelemetryCountAPIv1List{})) // on the response
+
+	ws.Route(ws.GET("/telemetry/stats/active").Filter(basicAuthenticate).To(getTelemetryActive).
+	// docs
+		Doc("gets the number of installs used within the last day, week and month - cached for an hour").
+		Operation("getTelemetryActive").
+		Writes(TelemetryActiveAPIv1{})) // on the response
+
+	ws.Route(ws.GET("/telemetry/stats/adoption").Filter(basicAuthenticate).To(getTelemetryAdoption).
+	// docs
+		Doc("gets per day/week the installs used in or after that period by the version used at its end - cached for an hour").
+		Operation("getTelemetryAdoption").
+		Param(ws.QueryParameter("interval", "'week' (default) or 'day'").DataType("string")).
+		Param(ws.QueryParameter("from", "Start of the first period (RFC3339) - default 12 weeks ago").DataType("string")).
+		Writes(TelemetryAdoptionAPIv1List{})) // on the response
+
+	ws.Route(ws.GET("/telemetry/stats/transitions").Filter(basicAuthenticate).To(getTelemetryTransitions).
+	// docs
+		Doc("gets the number of version upgrades or OS switches (from -> to) since a date - cached for an hour").
+		Operation("getTelemetryTransitions").
+		Param(ws.QueryParameter("type", "'version' (default) or 'os'").DataType("string")).
+		Param(ws.QueryParameter("from", "Changes after (RFC3339) - default 30 days ago").DataType("string")).
+		Writes(TelemetryCountAPIv1List{})) // on the response
+
+	// history - processing see "telemetry_history.go"
+	ws.Route(ws.GET("/telemetry/{key}/history").Filter(basicAuthenticate).To(getTelemetryHistory).
+	// docs
+		Doc("gets the install, version and OS change events of a user key - oldest first").
+		Operation("getTelemetryHistory").
+		Param(ws.PathParameter("key", "user key of the telemetry data").DataType("string")).
+		Writes(TelemetryEventAPIv1List{})) // on the response
+
+	// called by cron (see cron.yaml) - processing see "telemetry_ingest.go"
+	ws.Route(ws.GET("/telemetryingest").Filter(cronOrAdminAuthenticate).To(ingestTelemetry).
+	// docs
+		Doc("writes the queued telemetry updates in batches").
+		Operation("ingestTelemetry").
+		Writes(TelemetryIngestAPIv1{})) // on the response
+
+	// called by cron (see cron.yaml), continued by push tasks
+	ws.Route(ws.GET("/telemetryretention").Filter(cronOrAdminAuthenticate).To(applyTelemetryRetention).
+	// docs
+		Doc("deletes or coarsens telemetry data not updated within the retention period - in buckets, continue with cursor").
+		Operation("applyTelemetryRetention").
+		Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+		Writes(TelemetryRetentionAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/telemetrykeymigration").Filter(adminAuthenticate).To(migrateTelemetryKeys).
+	// docs
+		Doc("moves a bucket of telemetry data stored below the common ancestor to own entity groups - repeat with the returned cursor until it's empty").
+		Operation("migrateTelemetryKeys").
+		Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+		Writes(TelemetryKeyMigrationAPIv1{})) // on the response
+
+	ws.Route(ws.PUT("/telemetrycoarsenedmigration").Filter(adminAuthenticate).To(migrateTelemetryCoarsened).
+	// docs
+		Doc("stores the coarsened flag of a bucket of telemetry data stored before it was introduced - repeat with the returned cursor until it's empty").
+		Operation("migrateTelemetryCoarsened").
+		Param(ws.QueryParameter("cursor", "cursor returned by the previous call").DataType("string")).
+		Writes(TelemetryCoarsenedMigrationAPIv1{})) // on the response
+
 	// all routes defined - let's go
 
 	restful.Add(ws)
@@ -255,12 +597,20 @@ func init() {
 
 // global declarations
 const basicauth = "Basic_Auth"
+const adminauth = "Admin_Auth"
+const requestAttribute_Admin = "admin"
 const authorization = "Authorization"
+const appEngineCron = "X-Appengine-Cron"
+const appEngineQueueName = "X-Appengine-Queuename"
 const dateTimeLayout = "2006-01-02T15:04:05Z"
 const (
 	http_UnprocessableEntity = 422
 )
 const status_unprocessable = "Error - CloudDB Status does not allow processing the request"
+const status_partialOutage = "Error - CloudDB is partially unavailable - please retry later"
+
+// Retry-After if the end of a partial failure is not known
+const defaultRetryAfter = 5 * time.Minute
 
 
 func basicAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
@@ -268,32 +618,135 @@ func basicAuthenticate(req *restful.Request, resp *restful.Response, chain *rest
 	if secretClientId := os.Getenv(basicauth); secretClientId != "" {
 		if fmt.Sprint("Basic ",secretClientId) != headerClientId {
 			resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
-			resp.WriteErrorString(http.StatusUnauthorized, "Not Authorized")
+			addErrorResponse(resp, http.StatusUnauthorized, errorCode_Unauthorized, "Not Authorized", "")
 			return
 		}
 	} else {
 		resp.AddHeader("WWW-Authenticate", "Basic realm=Protected Area")
-		resp.WriteErrorString(http.StatusInternalServerError, "Authorization configuration missing on Server")
+		addErrorResponse(resp, http.StatusInternalServerError, errorCode_ServerConfig, "Authorization configuration missing on Server", "")
 		return
 	}
 
 	chain.ProcessFilter(req, resp)
 } // basicAuthenticate
 
+// cronOrAdminAuthenticate accepts the requests of App Engine cron and push tasks (the headers
+// are removed from all external requests by App Engine) or of an admin
+func cronOrAdminAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if req.Request.Header.Get(appEngineCron) == "true" || req.Request.Header.Get(appEngineQueueName) != "" {
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	adminAuthenticate(req, resp, chain)
+}
+
+// adminAuthenticate only accepts the credentials of an admin (see "Admin_Auth") - these are
+// not known to GoldenCheetah, the name of the admin is available via requestAdmin()
+func adminAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if os.Getenv(adminauth) == "" {
+		addErrorResponse(resp, http.StatusInternalServerError, errorCode_ServerConfig, "Admin authorization configuration missing on Server", "")
+		return
+	}
+	name := adminCredentialName(req)
+	if name == "" {
+		resp.AddHeader("WWW-Authenticate", "Basic realm=Admin Area")
+		addErrorResponse(resp, http.StatusUnauthorized, errorCode_Unauthorized, "Not Authorized", "")
+		return
+	}
+	req.SetAttribute(requestAttribute_Admin, name)
+
+	chain.ProcessFilter(req, resp)
+}
+
+// basicOrAdminAuthenticate accepts the requests of GoldenCheetah and of admins - the handler
+// uses requestAdmin() to decide what an admin may see in addition
+func basicOrAdminAuthenticate(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+	if name := adminCredentialName(req); name != "" {
+		req.SetAttribute(requestAttribute_Admin, name)
+		chain.ProcessFilter(req, resp)
+		return
+	}
+	basicAuthenticate(req, resp, chain)
+}
+
+// adminCredentialName returns the user name of the admin credentials sent with the request or
+// "" - "Admin_Auth" is a comma separated list of Basic credentials (base64 of "name:password")
+func adminCredentialName(req *restful.Request) string {
+	headerClientId := req.Request.Header.Get(authorization)
+	for _, secretAdminId := range strings.Split(os.Getenv(adminauth), ",") {
+		secretAdminId = strings.TrimSpace(secretAdminId)
+		if secretAdminId == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(fmt.Sprint("Basic ", secretAdminId)), []byte(headerClientId)) != 1 {
+			continue
+		}
+		if credentials, err := b64.StdEncoding.DecodeString(secretAdminId); err == nil {
+			if name := strings.SplitN(string(credentials), ":", 2)[0]; name != "" {
+				return name
+			}
+		}
+		return requestAttribute_Admin
+	}
+	return ""
+}
+
+// requestAdmin returns the name of the authenticated admin or "" for all other requests
+func requestAdmin(req *restful.Request) string {
+	if name, ok := req.Attribute(requestAttribute_Admin).(string); ok {
+		return name
+	}
+	return ""
+}
+
 func filterCloudDBStatus(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 	ctx := appengine.NewContext(req.Request)
 
-	if internalGetCurrentStatus(ctx) != Status_Ok {
-		addPlainTextError(resp, http_UnprocessableEntity, status_unprocessable)
+	statusDB, nextChange := internalGetCurrentStatusEntity(ctx)
+	operation := requestOperation(req)
+
+	if statusDB.blocks(requestArtifactKind(req), operation) {
+		if statusDB.Status != Status_PartialFailure {
+			addErrorResponse(resp, http_UnprocessableEntity, errorCode_StatusUnprocessable, status_unprocessable, "")
+			return
+		}
+		// temporary - tell the client when to try again
+		retryAfter := defaultRetryAfter
+		if !nextChange.IsZero() && time.Until(nextChange) > 0 {
+			retryAfter = time.Until(nextChange)
+		}
+		resp.AddHeader("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		addErrorResponse(resp, http.StatusServiceUnavailable, errorCode_PartialOutage, status_partialOutage, operation)
 		return
 	}
 
 	chain.ProcessFilter(req, resp)
 }
 
+// requestOperation returns the status operation of a request - the download counter is
+// updated when GoldenCheetah reads a chart, so it's a read
+func requestOperation(req *restful.Request) string {
+	if req.Request.Method == http.MethodGet || req.Request.Method == http.MethodHead {
+		return statusOperation_Read
+	}
+	if strings.HasPrefix(req.Request.URL.Path, "/v1/gchartuse/") {
+		return statusOperation_Read
+	}
+	return statusOperation_Write
+}
 
-// Convenience functions for error handling
-func addPlainTextError( r *restful.Response, httpStatus int, errorReason string ) {
-	r.AddHeader("Content-Type", "text/plain")
-	r.WriteErrorString(httpStatus, errorReason)
+// requestArtifactKind returns the artifact kind a request works on - e.g. "gchart" for
+// "/v1/gchartheader" or the "artifactKind" path parameter
+func requestArtifactKind(req *restful.Request) string {
+	if kind := req.PathParameter("artifactKind"); kind != "" {
+		return kind
+	}
+	path := strings.TrimPrefix(req.Request.URL.Path, "/v1/")
+	for _, kind := range []string{artifactKind_GChart, artifactKind_UserMetric} {
+		if strings.HasPrefix(path, kind) {
+			return kind
+		}
+	}
+	return strings.SplitN(path, "/", 2)[0]
 }
+
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Texts in the languages of GoldenCheetah (status and version texts) - selected by Accept-Language
+// ---------------------------------------------------------------------------------------------------------------//
+
+// LocalizedText is a translation of a text - stored as part of the entity which owns the text
+type LocalizedText struct {
+	Language string `datastore:",noindex"` // e.g. "de" or "pt-br" (lower case)
+	Text     string `datastore:",noindex"`
+}
+
+// the untranslated text of an entity is English
+const defaultTextLanguage = "en"
+
+const acceptLanguageHeader = "Accept-Language"
+
+// mapAPItoDBLocalizedTexts converts the "language -> text" map of the API (sorted by language)
+func mapAPItoDBLocalizedTexts(texts map[string]string) []LocalizedText {
+	var localized []LocalizedText
+	for language, text := range texts {
+		language = strings.ToLower(strings.TrimSpace(language))
+		if language == "" || text == "" {
+			continue
+		}
+		localized = append(localized, LocalizedText{Language: language, Text: text})
+	}
+	sort.Slice(localized, func(i, j int) bool { return localized[i].Language < localized[j].Language })
+	return localized
+}
+
+// acceptedLanguages returns the languages of an Accept-Language header (e.g. "de-CH,de;q=0.9,en;q=0.8")
+// ordered by preference - lower case, without "*" and languages with q=0
+func acceptedLanguages(header string) []string {
+	type weightedLanguage struct {
+		language string
+		q        float64
+	}
+	var weighted []weightedLanguage
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := strings.ToLower(strings.TrimSpace(fields[0]))
+		if language == "" || language == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		weighted = append(weighted, weightedLanguage{language, q})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool { return weighted[i].q > weighted[j].q })
+
+	languages := make([]string, len(weighted))
+	for i, w := range weighted {
+		languages[i] = w.language
+	}
+	return languages
+}
+
+// primaryLanguage returns the language without region - e.g. "de" for "de-ch"
+func primaryLanguage(language string) string {
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		return language[:i]
+	}
+	return language
+}
+
+// localizedText selects the text of the first accepted language which is available - an exact match
+// or a translation with the same primary language - and falls back to English (the untranslated text)
+func localizedText(languages []string, text string, texts []LocalizedText) (string, string) {
+	for _, language := range languages {
+		for _, localized := range texts {
+			if localized.Language == language {
+				return localized.Language, localized.Text
+			}
+		}
+		if primaryLanguage(language) == defaultTextLanguage && text != "" {
+			return defaultTextLanguage, text
+		}
+		for _, localized := range texts {
+			if primaryLanguage(localized.Language) == primaryLanguage(language) {
+				return localized.Language, localized.Text
+			}
+		}
+	}
+	for _, localized := range texts {
+		if localized.Language == defaultTextLanguage {
+			return localized.Language, localized.Text
+		}
+	}
+	return defaultTextLanguage, text
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"de-CH,de;q=0.9,en;q=0.8", []string{"de-ch", "de", "en"}},
+		{"en;q=0.5, fr ,pt-BR;q=0.7", []string{"fr", "pt-br", "en"}},
+		{"it;q=0.8,es;q=0.8", []string{"it", "es"}},
+		{"*,ja;q=0,nl;q=0.1", []string{"nl"}},
+		{"cs;q=abc", []string{"cs"}},
+		{" , ;q=1", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := acceptedLanguages(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("acceptedLanguages(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalizedText(t *testing.T) {
+	texts := []LocalizedText{
+		{Language: "de", Text: "Wartung"},
+		{Language: "fr", Text: "Maintenance (fr)"},
+		{Language: "pt-br", Text: "Manutenção"},
+	}
+	englishTranslation := []LocalizedText{{Language: "en", Text: "Maintenance (en)"}}
+
+	tests := []struct {
+		name         string
+		languages    []string
+		text         string
+		texts        []LocalizedText
+		wantLanguage string
+		wantText     string
+	}{
+		{"exact", []string{"fr"}, "Maintenance", texts, "fr", "Maintenance (fr)"},
+		{"exact with region", []string{"pt-br"}, "Maintenance", texts, "pt-br", "Manutenção"},
+		{"primary language of the accepted one", []string{"de-ch"}, "Maintenance", texts, "de", "Wartung"},
+		{"primary language of the translation", []string{"pt"}, "Maintenance", texts, "pt-br", "Manutenção"},
+		{"order of preference", []string{"it", "de", "fr"}, "Maintenance", texts, "de", "Wartung"},
+		{"english before later languages", []string{"en-gb", "de"}, "Maintenance", texts, "en", "Maintenance"},
+		{"fallback to untranslated", []string{"ja"}, "Maintenance", texts, "en", "Maintenance"},
+		{"no accepted languages", nil, "Maintenance", texts, "en", "Maintenance"},
+		{"no texts", []string{"de"}, "Maintenance", nil, "en", "Maintenance"},
+		{"english translation without text", []string{"ja"}, "", englishTranslation, "en", "Maintenance (en)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			language, text := localizedText(tt.languages, tt.text, tt.texts)
+			if language != tt.wantLanguage || text != tt.wantText {
+				t.Errorf("localizedText() = %q, %q, want %q, %q", language, text, tt.wantLanguage, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestMapAPItoDBLocalizedTexts(t *testing.T) {
+	got := mapAPItoDBLocalizedTexts(map[string]string{" FR ": "Bonjour", "de": "Hallo", "": "ignored", "es": ""})
+	want := []LocalizedText{{Language: "de", Text: "Hallo"}, {Language: "fr", Text: "Bonjour"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mapAPItoDBLocalizedTexts() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Minimal reader for MaxMind DB files (e.g. GeoLite2-City.mmdb) - see https://maxmind.github.io/MaxMind-DB/
+// Only lookups are supported, records are returned as generic maps/slices/values.
+// ---------------------------------------------------------------------------------------------------------------//
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// the data section starts after the search tree and 16 bytes of zeros
+const mmdbDataSectionSeparator = 16
+
+var errMmdbInvalid = errors.New("invalid MaxMind DB file")
+
+type mmdbReader struct {
+	buffer     []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint // node of ::/96 - where IPv4 addresses start in an IPv6 tree
+}
+
+// openMmdb reads the complete file into memory
+func openMmdb(path string) (*mmdbReader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	markerIndex := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if markerIndex < 0 {
+		return nil, errMmdbInvalid
+	}
+	metadataStart := uint(markerIndex + len(mmdbMetadataMarker))
+	metadata, _, err := decodeMmdb(buffer, metadataStart, metadataStart)
+	if err != nil {
+		return nil, err
+	}
+	metadataMap, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errMmdbInvalid
+	}
+
+	r := &mmdbReader{
+		buffer:     buffer,
+		nodeCount:  mmdbUint(metadataMap["node_count"]),
+		recordSize: mmdbUint(metadataMap["record_size"]),
+		ipVersion:  mmdbUint(metadataMap["ip_version"]),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", r.recordSize)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.treeSize+mmdbDataSectionSeparator > uint(markerIndex) {
+		return nil, errMmdbInvalid
+	}
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			if node, err = r.readNode(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// lookup returns the record of the ip address, nil if there is none
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	bitCount := len(ip) * 8
+	var err error
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		if node, err = r.readNode(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node == r.nodeCount {
+		// not found
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errMmdbInvalid
+	}
+
+	dataStart := r.treeSize + mmdbDataSectionSeparator
+	offset := node - r.nodeCount - mmdbDataSectionSeparator + dataStart
+	record, _, err := decodeMmdb(r.buffer, offset, dataStart)
+	return record, err
+}
+
+func (r *mmdbReader) readNode(node uint, bit uint) (uint, error) {
+	b := r.buffer
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		if offset+3 > r.treeSize {
+			return 0, errMmdbInvalid
+		}
+		return uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2]), nil
+	case 28:
+		offset := node * 7
+		if offset+7 > r.treeSize {
+			return 0, errMmdbInvalid
+		}
+		if bit == 0 {
+			return uint(b[offset+3]&0xF0)<<20 | uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2]), nil
+		}
+		return uint(b[offset+3]&0x0F)<<24 | uint(b[offset+4])<<16 | uint(b[offset+5])<<8 | uint(b[offset+6]), nil
+	default:
+		offset := node*8 + bit*4
+		if offset+4 > r.treeSize {
+			return 0, errMmdbInvalid
+		}
+		return uint(binary.BigEndian.Uint32(b[offset:])), nil
+	}
+}
+
+// MaxMind DB data types
+const (
+	mmdbType_Extended = 0
+	mmdbType_Pointer  = 1
+	mmdbType_String   = 2
+	mmdbType_Double   = 3
+	mmdbType_Bytes    = 4
+	mmdbType_Uint16   = 5
+	mmdbType_Uint32   = 6
+	mmdbType_Map      = 7
+	mmdbType_Int32    = 8
+	mmdbType_Uint64   = 9
+	mmdbType_Uint128  = 10
+	mmdbType_Array    = 11
+	mmdbType_Boolean  = 14
+	mmdbType_Float    = 15
+)
+
+// decodeMmdb decodes the value at offset and returns it with the offset of the next value,
+// pointers are relative to base (start of the data or metadata section)
+func decodeMmdb(b []byte, offset uint, base uint) (interface{}, uint, error) {
+	if offset >= uint(len(b)) {
+		return nil, 0, errMmdbInvalid
+	}
+	ctrl := b[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbType_Extended {
+		if offset >= uint(len(b)) {
+			return nil, 0, errMmdbInvalid
+		}
+		typ = 7 + uint(b[offset])
+		offset++
+	}
+
+	if typ == mmdbType_Pointer {
+		pointerSize := uint(ctrl>>3)&0x3 + 1
+		if offset+pointerSize > uint(len(b)) {
+			return nil, 0, errMmdbInvalid
+		}
+		vbits := uint(ctrl & 0x7)
+		var pointer uint
+		switch pointerSize {
+		case 1:
+			pointer = vbits<<8 | uint(b[offset])
+		case 2:
+			pointer = (vbits<<16 | uint(b[offset])<<8 | uint(b[offset+1])) + 2048
+		case 3:
+			pointer = (vbits<<24 | uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b[offset:]))
+		}
+		value, _, err := decodeMmdb(b, base+pointer, base)
+		return value, offset + pointerSize, err
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extraBytes := size - 28
+		if offset+extraBytes > uint(len(b)) {
+			return nil, 0, errMmdbInvalid
+		}
+		var extra uint
+		for i := uint(0); i < extraBytes; i++ {
+			extra = extra<<8 | uint(b[offset+i])
+		}
+		offset += extraBytes
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case mmdbType_Map:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMmdb(b, offset, base)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := decodeMmdb(b, next, base)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errMmdbInvalid
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbType_Array:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decodeMmdb(b, offset, base)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbType_Boolean:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(b)) {
+		return nil, 0, errMmdbInvalid
+	}
+	data := b[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case mmdbType_String:
+		return string(data), offset, nil
+	case mmdbType_Bytes:
+		return data, offset, nil
+	case mmdbType_Double:
+		if size != 8 {
+			return nil, 0, errMmdbInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), offset, nil
+	case mmdbType_Float:
+		if size != 4 {
+			return nil, 0, errMmdbInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), offset, nil
+	case mmdbType_Uint16, mmdbType_Uint32, mmdbType_Uint64, mmdbType_Uint128:
+		// uint128 values are cut to the lower 64 bits - they are not used for lookups
+		var value uint64
+		for _, d := range data {
+			value = value<<8 | uint64(d)
+		}
+		return value, offset, nil
+	case mmdbType_Int32:
+		var value uint32
+		for _, d := range data {
+			value = value<<8 | uint32(d)
+		}
+		return int64(int32(value)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+}
+
+func mmdbUint(value interface{}) uint {
+	if u, ok := value.(uint64); ok {
+		return uint(u)
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// MaxMind DB encoding of the test data - control byte is type (3 bits) and size (5 bits)
+
+func encodeMmdbControl(typ byte, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), typ - 7}
+	}
+	return []byte{typ<<5 | byte(size)}
+}
+
+func encodeMmdbString(s string) []byte {
+	return append(encodeMmdbControl(mmdbType_String, len(s)), s...)
+}
+
+func encodeMmdbUint16(v uint16) []byte {
+	return append(encodeMmdbControl(mmdbType_Uint16, 2), byte(v>>8), byte(v))
+}
+
+func encodeMmdbUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return append(encodeMmdbControl(mmdbType_Uint32, 4), b...)
+}
+
+func encodeMmdbMap(pairs ...[]byte) []byte {
+	b := encodeMmdbControl(mmdbType_Map, len(pairs)/2)
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDecodeMmdb(t *testing.T) {
+	double := make([]byte, 8)
+	binary.BigEndian.PutUint64(double, math.Float64bits(47.5))
+	float := make([]byte, 4)
+	binary.BigEndian.PutUint32(float, math.Float32bits(-1.5))
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		want  interface{}
+		next  uint
+		error bool
+	}{
+		{"string", encodeMmdbString("Berlin"), "Berlin", 7, false},
+		{"empty string", encodeMmdbString(""), "", 1, false},
+		{"long string", concat([]byte{mmdbType_String<<5 | 30, 0, 15}, []byte(long)), long, 303, false},
+		{"double", concat(encodeMmdbControl(mmdbType_Double, 8), double), 47.5, 9, false},
+		{"float", concat(encodeMmdbControl(mmdbType_Float, 4), float), -1.5, 6, false},
+		{"uint16", encodeMmdbUint16(0x1234), uint64(0x1234), 3, false},
+		{"uint32", encodeMmdbUint32(0xDEADBEEF), uint64(0xDEADBEEF), 5, false},
+		{"short uint32", []byte{mmdbType_Uint32<<5 | 1, 0x7F}, uint64(0x7F), 2, false},
+		{"int32", concat(encodeMmdbControl(mmdbType_Int32, 4), []byte{0xFF, 0xFF, 0xFF, 0xFE}), int64(-2), 6, false},
+		{"uint64", concat(encodeMmdbControl(mmdbType_Uint64, 8), []byte{1, 0, 0, 0, 0, 0, 0, 0}), uint64(1) << 56, 10, false},
+		{"boolean", encodeMmdbControl(mmdbType_Boolean, 1), true, 2, false},
+		{"bytes", concat(encodeMmdbControl(mmdbType_Bytes, 2), []byte{1, 2}), []byte{1, 2}, 3, false},
+		{"array", concat(encodeMmdbControl(mmdbType_Array, 2), encodeMmdbString("de"), encodeMmdbString("en")), []interface{}{"de", "en"}, 8, false},
+		{"map", encodeMmdbMap(encodeMmdbString("iso"), encodeMmdbString("DE"), encodeMmdbString("n"), encodeMmdbUint16(7)),
+			map[string]interface{}{"iso": "DE", "n": uint64(7)}, 13, false},
+		{"empty", nil, nil, 0, true},
+		{"truncated string", encodeMmdbString("Berlin")[:4], nil, 0, true},
+		{"truncated extended type", []byte{0}, nil, 0, true},
+		{"wrong double size", concat(encodeMmdbControl(mmdbType_Double, 4), float), nil, 0, true},
+		{"map key no string", encodeMmdbMap(encodeMmdbUint16(1), encodeMmdbString("x")), nil, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, next, err := decodeMmdb(tt.data, 0, 0)
+			if tt.error {
+				if err == nil {
+					t.Fatalf("no error, value %v", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(value, tt.want) {
+				t.Errorf("value = %#v, want %#v", value, tt.want)
+			}
+			if next != tt.next {
+				t.Errorf("next = %d, want %d", next, tt.next)
+			}
+		})
+	}
+}
+
+func TestDecodeMmdbPointer(t *testing.T) {
+	// the pointed value is placed at the offset of the pointer (relative to base = 2)
+	const base = 2
+	tests := []struct {
+		name    string
+		pointer []byte
+		target  uint
+	}{
+		{"size 1", []byte{mmdbType_Pointer<<5 | 0<<3 | 0x1, 0x02}, 0x102},
+		{"size 2", []byte{mmdbType_Pointer<<5 | 1<<3 | 0x0, 0x00, 0x10}, 0x10 + 2048},
+		{"size 3", []byte{mmdbType_Pointer<<5 | 2<<3 | 0x0, 0x00, 0x00, 0x05}, 0x05 + 526336},
+		{"size 4", []byte{mmdbType_Pointer<<5 | 3<<3, 0x00, 0x09, 0x00, 0x01}, 0x90001},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, base+tt.target+10)
+			copy(data, tt.pointer)
+			copy(data[base+tt.target:], encodeMmdbString("Paris"))
+
+			value, next, err := decodeMmdb(data, 0, base)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if value != "Paris" {
+				t.Errorf("value = %v, want Paris", value)
+			}
+			// the next value follows the pointer, not the pointed value
+			if next != uint(len(tt.pointer)) {
+				t.Errorf("next = %d, want %d", next, len(tt.pointer))
+			}
+		})
+	}
+
+	if _, _, err := decodeMmdb([]byte{mmdbType_Pointer<<5 | 0x1, 0xFF}, 0, 0); err == nil {
+		t.Errorf("pointer outside of the data is not rejected")
+	}
+}
+
+func TestMmdbReadNode(t *testing.T) {
+	tests := []struct {
+		recordSize  uint
+		node        []byte
+		left, right uint
+	}{
+		{24, []byte{0x12, 0x34, 0x56, 0xAB, 0xCD, 0xEF}, 0x123456, 0xABCDEF},
+		{28, []byte{0x12, 0x34, 0x56, 0x9A, 0xBC, 0xDE, 0xF0}, 0x9123456, 0xABCDEF0},
+		{32, []byte{0x12, 0x34, 0x56, 0x78, 0x9A, 0xBC, 0xDE, 0xF0}, 0x12345678, 0x9ABCDEF0},
+	}
+
+	for _, tt := range tests {
+		// node 1 - after an empty node 0
+		buffer := append(make([]byte, len(tt.node)), tt.node...)
+		r := &mmdbReader{buffer: buffer, recordSize: tt.recordSize, nodeCount: 2, treeSize: uint(len(buffer))}
+		left, err := r.readNode(1, 0)
+		if err != nil || left != tt.left {
+			t.Errorf("%d bit: left = %x (%v), want %x", tt.recordSize, left, err, tt.left)
+		}
+		right, err := r.readNode(1, 1)
+		if err != nil || right != tt.right {
+			t.Errorf("%d bit: right = %x (%v), want %x", tt.recordSize, right, err, tt.right)
+		}
+		if _, err := r.readNode(2, 0); err == nil {
+			t.Errorf("%d bit: node outside of the tree is not rejected", tt.recordSize)
+		}
+	}
+}
+
+// writeTestMmdb writes an IPv4 database: 0.0.0.0/2 -> Berlin, 64.0.0.0/2 -> Paris (via a pointer
+// to the city of Berlin's record), 128.0.0.0/1 -> not found
+func writeTestMmdb(t *testing.T, recordSize uint) string {
+	const nodeCount = 2
+	berlin := encodeMmdbMap(encodeMmdbString("city"), encodeMmdbString("Berlin"))
+	paris := encodeMmdbMap(encodeMmdbString("name"), encodeMmdbString("Paris"),
+		encodeMmdbString("country"), []byte{mmdbType_Pointer << 5, 0x06}) // -> map value of Berlin
+	data := concat(berlin, paris)
+
+	records := [][2]uint{
+		{1, nodeCount},
+		{nodeCount + mmdbDataSectionSeparator, nodeCount + mmdbDataSectionSeparator + uint(len(berlin))},
+	}
+	var tree []byte
+	for _, r := range records {
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]), byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		case 28:
+			tree = append(tree, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]), byte(r[0]>>24)<<4|byte(r[1]>>24),
+				byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		default:
+			tree = append(tree, byte(r[0]>>24), byte(r[0]>>16), byte(r[0]>>8), byte(r[0]),
+				byte(r[1]>>24), byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		}
+	}
+	metadata := encodeMmdbMap(encodeMmdbString("node_count"), encodeMmdbUint32(nodeCount),
+		encodeMmdbString("record_size"), encodeMmdbUint16(uint16(recordSize)),
+		encodeMmdbString("ip_version"), encodeMmdbUint16(4))
+
+	file := concat(tree, make([]byte, mmdbDataSectionSeparator), data, mmdbMetadataMarker, metadata)
+	dir, err := ioutil.TempDir("", "mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(path, file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMmdbLookup(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		path := writeTestMmdb(t, recordSize)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		r, err := openMmdb(path)
+		if err != nil {
+			t.Fatalf("%d bit: open failed %v", recordSize, err)
+		}
+		tests := []struct {
+			ip   string
+			want interface{}
+		}{
+			{"10.1.2.3", map[string]interface{}{"city": "Berlin"}},
+			{"100.1.2.3", map[string]interface{}{"name": "Paris", "country": "Berlin"}},
+			{"200.1.2.3", nil},
+			{"2001:db8::1", nil},
+		}
+		for _, tt := range tests {
+			record, err := r.lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Errorf("%d bit %s: unexpected error %v", recordSize, tt.ip, err)
+				continue
+			}
+			if !reflect.DeepEqual(record, tt.want) {
+				t.Errorf("%d bit %s: record = %#v, want %#v", recordSize, tt.ip, record, tt.want)
+			}
+		}
+	}
+
+	if _, err := openMmdb(os.DevNull); err != errMmdbInvalid {
+		t.Errorf("file without metadata: error = %v, want errMmdbInvalid", err)
+	}
+}
@@ -0,0 +1,412 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Privacy - data export and erasure of a creator (GDPR) - both are only available to admins (see "Admin_Auth"),
+// since the CreatorId is public and can't prove that a request comes from the creator
+// ---------------------------------------------------------------------------------------------------------------//
+
+// All data stored for a CreatorId
+type CreatorExportAPIv1 struct {
+	CreatorId    string                `json:"creatorId"`
+	Profile      *CreatorAPIv1         `json:"profile,omitempty"`
+	GCharts      GChartGetAPIv1List    `json:"gcharts"`
+	UserMetrics  UserMetricAPIv1List   `json:"usermetrics"`
+	Curators     CuratorAPIv1List      `json:"curators"`
+	CuratorAudit CuratorAuditAPIv1List `json:"curatorAudit"`
+	Ratings      []RatingGetAPIv1      `json:"ratings"`
+	Comments     CommentGetAPIv1List   `json:"comments"` // written or deleted by the creator
+	Reports      ReportGetAPIv1List    `json:"reports"`  // filed or resolved by the creator
+}
+
+// Number of entities changed by the erasure
+type CreatorErasureAPIv1 struct {
+	GCharts     int `json:"gcharts"`
+	UserMetrics int `json:"usermetrics"`
+	Curators    int `json:"curators"`
+	Ratings     int `json:"ratings"`
+	Comments    int `json:"comments"`
+	Reports     int `json:"reports"`
+}
+
+// the multi calls of the datastore are limited to 500 entities
+const privacyBatchSize = 500
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func exportCreatorData(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	creatorId := request.PathParameter("creatorId")
+
+	export := CreatorExportAPIv1{
+		CreatorId:    creatorId,
+		GCharts:      GChartGetAPIv1List{},
+		UserMetrics:  UserMetricAPIv1List{},
+		Curators:     CuratorAPIv1List{},
+		CuratorAudit: CuratorAuditAPIv1List{},
+		Ratings:      []RatingGetAPIv1{},
+		Comments:     CommentGetAPIv1List{},
+		Reports:      ReportGetAPIv1List{},
+	}
+
+	creatorDB, err := loadCreator(ctx, creatorId)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if creatorDB != nil {
+		export.Profile = new(CreatorAPIv1)
+		mapDBtoAPICreator(creatorDB, export.Profile)
+		export.Profile.CreatorId = creatorId
+	}
+
+	var chartsOnDBList []GChartEntity
+	k, err := datastore.NewQuery(gChartDBEntity).Filter("Header.CreatorId =", creatorId).GetAll(ctx, &chartsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range chartsOnDBList {
+		chartDB := &chartsOnDBList[i]
+		if err := loadGChartImages(ctx, chartDB, true, false); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		var chart GChartGetAPIv1
+		if err := mapDBtoAPIGChart(chartDB, &chart); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		chart.Header.Id = k[i].IntID()
+		resolveCreator(ctx, creatorId, &chart.CreatorNick, &chart.CreatorEmail)
+		export.GCharts = append(export.GCharts, chart)
+	}
+
+	var metricsOnDBList []UserMetricEntity
+	k, err = datastore.NewQuery(usermetricDBEntity).Filter("Header.CreatorId =", creatorId).GetAll(ctx, &metricsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range metricsOnDBList {
+		var metric UserMetricAPIv1
+		if err := mapDBtoAPIUserMetric(&metricsOnDBList[i], &metric); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		metric.Header.Id = k[i].IntID()
+		resolveCreator(ctx, creatorId, &metric.CreatorNick, &metric.CreatorEmail)
+		export.UserMetrics = append(export.UserMetrics, metric)
+	}
+
+	var curatorOnDBList []CuratorEntity
+	k, err = datastore.NewQuery(curatorDBEntity).Filter("CuratorId =", creatorId).GetAll(ctx, &curatorOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range curatorOnDBList {
+		var curator CuratorAPIv1
+		mapDBtoAPICurator(&curatorOnDBList[i], &curator)
+		curator.Id = k[i].IntID()
+		export.Curators = append(export.Curators, curator)
+	}
+
+	var auditOnDBList []CuratorAuditEntity
+	_, err = datastore.NewQuery(curatorAuditDBEntity).Filter("CuratorId =", creatorId).GetAll(ctx, &auditOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range auditOnDBList {
+		var audit CuratorAuditAPIv1
+		mapDBtoAPICuratorAudit(&auditOnDBList[i], &audit)
+		export.CuratorAudit = append(export.CuratorAudit, audit)
+	}
+
+	var ratingOnDBList []RatingEntity
+	_, err = datastore.NewQuery(ratingDBEntity).Filter("CreatorId =", creatorId).GetAll(ctx, &ratingOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for _, ratingDB := range ratingOnDBList {
+		export.Ratings = append(export.Ratings, RatingGetAPIv1{
+			ArtifactKind: ratingDB.ArtifactKind,
+			ArtifactId:   ratingDB.ArtifactId,
+			OwnStars:     ratingDB.Stars,
+		})
+	}
+
+	// a comment written and deleted by the creator is found twice
+	exported := make(map[int64]bool)
+	for _, property := range []string{"CreatorId =", "DeletedBy ="} {
+		var commentsOnDBList []CommentEntity
+		k, err = datastore.NewQuery(commentDBEntity).Filter(property, creatorId).GetAll(ctx, &commentsOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		for i := range commentsOnDBList {
+			if exported[k[i].IntID()] {
+				continue
+			}
+			exported[k[i].IntID()] = true
+			var comment CommentGetAPIv1
+			mapDBtoAPIComment(&commentsOnDBList[i], &comment)
+			comment.Id = k[i].IntID()
+			export.Comments = append(export.Comments, comment)
+		}
+	}
+
+	// the reporter can't resolve the own report, so no report is found twice
+	for _, property := range []string{"ReporterId =", "ResolvedBy ="} {
+		var reportOnDBList []ReportEntity
+		_, err = datastore.NewQuery(reportDBEntity).Ancestor(reportEntityRootKey(ctx)).Filter(property, creatorId).GetAll(ctx, &reportOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		for i := range reportOnDBList {
+			var report ReportGetAPIv1
+			mapDBtoAPIReport(&reportOnDBList[i], &report)
+			export.Reports = append(export.Reports, report)
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, export)
+}
+
+// eraseCreatorData removes all personal data of a creator - uploads are deleted (like a
+// delete by the creator, so that GoldenCheetah removes them too) and their creator fields
+// are cleared, profile, comments, ratings (incl. their share of the rating aggregates),
+// reports and curator records are removed - the creator is removed from comments deleted
+// and reports resolved as curator
+func eraseCreatorData(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	creatorId := request.PathParameter("creatorId")
+	admin := requestAdmin(request)
+
+	var erasure CreatorErasureAPIv1
+
+	// charts and user metrics can be large, so they are processed one by one
+	chartKeys, err := datastore.NewQuery(gChartDBEntity).Filter("Header.CreatorId =", creatorId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for _, key := range chartKeys {
+		chartDB := new(GChartEntity)
+		if err := datastore.Get(ctx, key, chartDB); err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		clearGChartContent(ctx, key, chartDB)
+		chartDB.Header.CreatorId = ""
+		chartDB.Header.Deleted = true
+		chartDB.Header.LastChanged = time.Now()
+		chartDB.CreatorNick = ""
+		chartDB.CreatorEmail = ""
+		if _, err := datastore.Put(ctx, key, chartDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		erasure.GCharts++
+	}
+
+	metricKeys, err := datastore.NewQuery(usermetricDBEntity).Filter("Header.CreatorId =", creatorId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for _, key := range metricKeys {
+		metricDB := new(UserMetricEntity)
+		if err := datastore.Get(ctx, key, metricDB); err != nil && !isErrFieldMismatch(err) {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		clearUserMetricContent(metricDB)
+		metricDB.Header.CreatorId = ""
+		metricDB.Header.Deleted = true
+		metricDB.Header.LastChanged = time.Now()
+		metricDB.CreatorNick = ""
+		metricDB.CreatorEmail = ""
+		if _, err := datastore.Put(ctx, key, metricDB); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		erasure.UserMetrics++
+	}
+
+	// curator records and the audit trail share one entity group
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		erasure.Curators = 0
+		var curatorOnDBList []CuratorEntity
+		curatorKeys, err := datastore.NewQuery(curatorDBEntity).Ancestor(curatorEntityRootKey(tc)).Filter("CuratorId =", creatorId).GetAll(tc, &curatorOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		var auditOnDBList []CuratorAuditEntity
+		auditKeys, err := datastore.NewQuery(curatorAuditDBEntity).Ancestor(curatorEntityRootKey(tc)).Filter("CuratorId =", creatorId).GetAll(tc, &auditOnDBList)
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		for i := range auditOnDBList {
+			auditOnDBList[i].Nickname = ""
+			auditOnDBList[i].Email = ""
+		}
+		if len(auditKeys) > 0 {
+			if _, err := datastore.PutMulti(tc, auditKeys, auditOnDBList); err != nil {
+				return err
+			}
+		}
+		for i := range curatorOnDBList {
+			if err := datastore.Delete(tc, curatorKeys[i]); err != nil {
+				return err
+			}
+			curatorOnDBList[i].Nickname = ""
+			curatorOnDBList[i].Email = ""
+			if err := addCuratorAudit(tc, curatorAudit_Remove, &curatorOnDBList[i], admin); err != nil {
+				return err
+			}
+			erasure.Curators++
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// the aggregates are changed together with the rating
+	ratingKeys, err := datastore.NewQuery(ratingDBEntity).Filter("CreatorId =", creatorId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for _, key := range ratingKeys {
+		if err := deleteRating(ctx, key); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		erasure.Ratings++
+	}
+
+	commentKeys, err := datastore.NewQuery(commentDBEntity).Filter("CreatorId =", creatorId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if err := deleteInBatches(ctx, commentKeys); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	erasure.Comments = len(commentKeys)
+
+	var deletedCommentsOnDBList []CommentEntity
+	commentKeys, err = datastore.NewQuery(commentDBEntity).Filter("DeletedBy =", creatorId).GetAll(ctx, &deletedCommentsOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range deletedCommentsOnDBList {
+		deletedCommentsOnDBList[i].DeletedBy = ""
+	}
+	for start := 0; start < len(commentKeys); start += privacyBatchSize {
+		end := start + privacyBatchSize
+		if end > len(commentKeys) {
+			end = len(commentKeys)
+		}
+		if _, err := datastore.PutMulti(ctx, commentKeys[start:end], deletedCommentsOnDBList[start:end]); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	// reports are kept for the curation - the ones of the creator are removed
+	reportKeys, err := datastore.NewQuery(reportDBEntity).Ancestor(reportEntityRootKey(ctx)).Filter("ReporterId =", creatorId).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if err := deleteInBatches(ctx, reportKeys); err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	erasure.Reports = len(reportKeys)
+
+	var resolvedReportOnDBList []ReportEntity
+	reportKeys, err = datastore.NewQuery(reportDBEntity).Ancestor(reportEntityRootKey(ctx)).Filter("ResolvedBy =", creatorId).GetAll(ctx, &resolvedReportOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	for i := range resolvedReportOnDBList {
+		resolvedReportOnDBList[i].ResolvedBy = ""
+	}
+	for start := 0; start < len(reportKeys); start += privacyBatchSize {
+		end := start + privacyBatchSize
+		if end > len(reportKeys) {
+			end = len(reportKeys)
+		}
+		if _, err := datastore.PutMulti(ctx, reportKeys[start:end], resolvedReportOnDBList[start:end]); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	if err := datastore.Delete(ctx, creatorEntityKey(ctx, creatorId)); err != nil && err != datastore.ErrNoSuchEntity {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	log.Infof(ctx, "Erased data of creator %s (requested by %s): %+v", creatorId, admin, erasure)
+
+	response.WriteHeaderAndEntity(http.StatusOK, erasure)
+}
+
+// deleteInBatches deletes the keys within the limit of the multi calls
+func deleteInBatches(ctx context.Context, keys []*datastore.Key) error {
+	for start := 0; start < len(keys); start += privacyBatchSize {
+		end := start + privacyBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := datastore.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
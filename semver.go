@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Semantic versions (e.g. "3.5.0-rc1") - relate the build numbers of the versions to the GC version strings
+// ---------------------------------------------------------------------------------------------------------------//
+
+type semanticVersion struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease string // e.g. "rc1" or "dev.2" - empty for a release
+}
+
+var errNoSemanticVersion = errors.New("no semantic version - expected e.g. '3.5.1' or '3.5.1-rc1'")
+
+// parseSemanticVersion accepts the strict format "3.5.1-rc1" and the formats used by GC
+// (e.g. "v3.5", "3.5 RC1" or "3.6-DEV2004") - build metadata ("+...") is ignored
+func parseSemanticVersion(s string) (semanticVersion, error) {
+	var version semanticVersion
+
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+
+	// numeric core up to the first character which is neither a digit nor a dot
+	end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end < 0 {
+		end = len(s)
+	}
+	core := strings.TrimSuffix(s[:end], ".")
+	parts := strings.Split(core, ".")
+	if core == "" || len(parts) > 3 {
+		return version, errNoSemanticVersion
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return version, errNoSemanticVersion
+		}
+		numbers[i] = number
+	}
+	version.Major, version.Minor, version.Patch = numbers[0], numbers[1], numbers[2]
+
+	preRelease := strings.TrimLeft(s[end:], "- .")
+	version.PreRelease = strings.ToLower(strings.Join(strings.Fields(preRelease), "."))
+	return version, nil
+}
+
+// String returns the normalized format - e.g. "3.5.0-rc1"
+func (v semanticVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.PreRelease != "" {
+		s += "-" + v.PreRelease
+	}
+	return s
+}
+
+// compareSemanticVersions returns -1, 0 or 1 if a is older, equal or newer than b - a pre-release
+// is older than the release of the same version
+func compareSemanticVersions(a semanticVersion, b semanticVersion) int {
+	for _, diff := range []int{a.Major - b.Major, a.Minor - b.Minor, a.Patch - b.Patch} {
+		if diff != 0 {
+			return sign(diff)
+		}
+	}
+	switch {
+	case a.PreRelease == b.PreRelease:
+		return 0
+	case a.PreRelease == "":
+		return 1
+	case b.PreRelease == "":
+		return -1
+	}
+
+	// pre-release identifiers one by one
+	aIds, bIds := strings.Split(a.PreRelease, "."), strings.Split(b.PreRelease, ".")
+	for i := 0; i < len(aIds) && i < len(bIds); i++ {
+		if result := comparePreReleaseIdentifiers(aIds[i], bIds[i]); result != 0 {
+			return result
+		}
+	}
+	return sign(len(aIds) - len(bIds))
+}
+
+// comparePreReleaseIdentifiers compares the text and number parts of the identifiers one by one -
+// numbers numerically and before text, so that "rc10" is newer than "rc9"
+func comparePreReleaseIdentifiers(a string, b string) int {
+	aParts, bParts := splitPreReleaseIdentifier(a), splitPreReleaseIdentifier(b)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNumber, aErr := strconv.Atoi(aParts[i])
+		bNumber, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNumber != bNumber {
+				return sign(aNumber - bNumber)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case aParts[i] != bParts[i]:
+			return strings.Compare(aParts[i], bParts[i])
+		}
+	}
+	return sign(len(aParts) - len(bParts))
+}
+
+// splitPreReleaseIdentifier splits an identifier into its text and number parts - e.g. "rc10" into "rc", "10"
+func splitPreReleaseIdentifier(id string) []string {
+	var parts []string
+	start := 0
+	for i := 1; i <= len(id); i++ {
+		if i == len(id) || isDigit(id[i]) != isDigit(id[i-1]) {
+			parts = append(parts, id[start:i])
+			start = i
+		}
+	}
+	return parts
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func sign(i int) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	}
+	return 0
+}
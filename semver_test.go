@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSemanticVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		error   bool
+	}{
+		{"3.5.1", "3.5.1", false},
+		{"3.5.1-rc1", "3.5.1-rc1", false},
+		{"v3.5", "3.5.0", false},
+		{"V3", "3.0.0", false},
+		{"3.5 RC1", "3.5.0-rc1", false},
+		{"3.6-DEV2004", "3.6.0-dev2004", false},
+		{"3.5.0-rc.2+build.7", "3.5.0-rc.2", false},
+		{" 3.5. beta 2 ", "3.5.0-beta.2", false},
+		{"", "", true},
+		{"rc1", "", true},
+		{"3.5.1.2", "", true},
+		{"3..5", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			semVer, err := parseSemanticVersion(tt.version)
+			if tt.error {
+				if err == nil {
+					t.Fatalf("no error, version %v", semVer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if semVer.String() != tt.want {
+				t.Errorf("version = %q, want %q", semVer.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareSemanticVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"3.5.0", "3.5.0", 0},
+		{"3.5 RC1", "3.5.0-rc1", 0},
+		{"3.5.1", "3.5.0", 1},
+		{"3.6", "3.5.9", 1},
+		{"4.0", "3.10", 1},
+		{"3.10", "3.9", 1},
+		{"3.5.0", "3.5.0-rc1", 1},
+		{"3.5.0-rc2", "3.5.0-rc1", 1},
+		{"3.5 RC10", "3.5 RC9", 1},
+		{"3.6-dev10", "3.6-dev9", 1},
+		{"3.5.0-rc", "3.5.0-rc1", -1},
+		{"3.5.0-rc1", "3.5.0-beta2", 1},
+		{"3.5.0-rc.10", "3.5.0-rc.9", 1},
+		{"3.5.0-rc.1", "3.5.0-rc.a", -1},
+		{"3.5.0-rc.1", "3.5.0-rc.1.1", -1},
+		{"3.5.0-1", "3.5.0-rc", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			a, err := parseSemanticVersion(tt.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseSemanticVersion(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := compareSemanticVersions(a, b); got != tt.want {
+				t.Errorf("compare(%s, %s) = %d, want %d", a, b, got, tt.want)
+			}
+			if got := compareSemanticVersions(b, a); got != -tt.want {
+				t.Errorf("compare(%s, %s) = %d, want %d", b, a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionReleasesRelease(t *testing.T) {
+	releases := versionReleases{3955: "3.5.0", 3960: "3.6.0-rc1"}
+
+	tests := []struct {
+		gcVersion string
+		want      string
+	}{
+		{"3955", "3.5.0"},
+		{" 3960 ", "3.6.0-rc1"},
+		{"4000", "4000"},
+		{"3.5", "3.5.0"},
+		{"3.6 RC1", "3.6.0-rc1"},
+		{"unknown", "unknown"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := releases.release(tt.gcVersion); got != tt.want {
+			t.Errorf("release(%q) = %q, want %q", tt.gcVersion, got, tt.want)
+		}
+	}
+}
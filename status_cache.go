@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Cache of the current status - read by the status API and by the status filter of every request
+// ---------------------------------------------------------------------------------------------------------------//
+
+// cachedStatus is the active status (Id 0 and Status_Ok if there is none), the scheduled
+// status windows and the next point of time where the active status may change
+type cachedStatus struct {
+	Id         int64
+	Status     StatusEntity
+	NextChange time.Time
+	Upcoming   []StatusEntityGetAPIv1
+}
+
+// StatusCache stores the cachedStatus until it expires or is invalidated
+type StatusCache interface {
+	Get(ctx context.Context) (*cachedStatus, bool)
+	Set(ctx context.Context, status *cachedStatus, expiration time.Duration)
+	Invalidate(ctx context.Context)
+}
+
+// configuration (see app.yaml)
+const statusCacheConfig = "Status_Cache" // "memcache" (default) or "memory"
+
+const (
+	statusCache_Memcache = "memcache"
+	statusCache_Memory   = "memory"
+)
+
+// a status changed on another instance (memory) or directly in the datastore is picked up latest after
+const statusCacheTTL = time.Minute
+
+var statusCache StatusCache
+var statusCacheOnce sync.Once
+
+// a fresh installation gets its initial status with the first status read of an instance
+var statusBootstrapOnce sync.Once
+
+// getStatusCache returns the configured status cache
+func getStatusCache() StatusCache {
+	statusCacheOnce.Do(func() {
+		switch os.Getenv(statusCacheConfig) {
+		case statusCache_Memory:
+			statusCache = &memoryStatusCache{}
+		default:
+			statusCache = memcacheStatusCache{}
+		}
+	})
+	return statusCache
+}
+
+// getCurrentStatusCached returns the current status from the cache - or reads it from the DB and
+// caches it until the TTL is over or the status changes, whatever comes first
+func getCurrentStatusCached(ctx context.Context) (*cachedStatus, error) {
+	cache := getStatusCache()
+	if status, ok := cache.Get(ctx); ok {
+		return status, nil
+	}
+
+	status, err := loadCachedStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := statusCacheTTL
+	if !status.NextChange.IsZero() && time.Until(status.NextChange) < expiration {
+		expiration = time.Until(status.NextChange)
+	}
+	if expiration > 0 {
+		cache.Set(ctx, status, expiration)
+	}
+	return status, nil
+}
+
+// invalidateStatusCache removes the current status from the cache (after a status change)
+func invalidateStatusCache(ctx context.Context) {
+	getStatusCache().Invalidate(ctx)
+}
+
+// loadCachedStatus reads the active and the scheduled status entries from the DB
+func loadCachedStatus(ctx context.Context) (*cachedStatus, error) {
+	statusBootstrapOnce.Do(func() {
+		if err := bootstrapStatus(ctx); err != nil {
+			log.Warningf(ctx, "Storing the initial status failed: %v", err)
+		}
+	})
+
+	statusDB, key, nextChange, err := loadCurrentStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &cachedStatus{NextChange: nextChange}
+	if statusDB != nil {
+		status.Id = key.IntID()
+		status.Status = *statusDB
+	} else {
+		status.Status.Status = Status_Ok
+	}
+
+	q := datastore.NewQuery(statusDBEntity).Ancestor(statusEntityRootKey(ctx)).Filter("ChangeDate >", time.Now()).Order("ChangeDate")
+	var upcomingOnDBList []StatusEntity
+	k, err := q.GetAll(ctx, &upcomingOnDBList)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	for i, upcomingDB := range upcomingOnDBList {
+		var upcomingAPI StatusEntityGetAPIv1
+		mapDBtoAPIStatus(&upcomingDB, &upcomingAPI)
+		upcomingAPI.Id = k[i].IntID()
+		status.Upcoming = append(status.Upcoming, upcomingAPI)
+	}
+	return status, nil
+}
+
+// ------------------- App Engine memcache (shared by all instances) -----------------------
+
+type memcacheStatusCache struct{}
+
+func (memcacheStatusCache) Get(ctx context.Context) (*cachedStatus, bool) {
+	status := new(cachedStatus)
+	if _, err := memcache.Gob.Get(ctx, statusMemcacheKey, status); err != nil {
+		return nil, false
+	}
+	return status, true
+}
+
+func (memcacheStatusCache) Set(ctx context.Context, status *cachedStatus, expiration time.Duration) {
+	// overwrite existing / ignore errors
+	memcache.Gob.Set(ctx, &memcache.Item{
+		Key:        statusMemcacheKey,
+		Object:     status,
+		Expiration: expiration,
+	})
+}
+
+func (memcacheStatusCache) Invalidate(ctx context.Context) {
+	// ignore errors - e.g. memcache.ErrCacheMiss
+	memcache.Delete(ctx, statusMemcacheKey)
+}
+
+// ------------------- in-process (self-hosting without memcache) --------------------------
+
+type memoryStatusCache struct {
+	mutex   sync.Mutex
+	status  *cachedStatus
+	expires time.Time
+}
+
+func (c *memoryStatusCache) Get(ctx context.Context) (*cachedStatus, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.status == nil || !time.Now().Before(c.expires) {
+		return nil, false
+	}
+	return c.status, true
+}
+
+func (c *memoryStatusCache) Set(ctx context.Context, status *cachedStatus, expiration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status = status
+	c.expires = time.Now().Add(expiration)
+}
+
+func (c *memoryStatusCache) Invalidate(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.status = nil
+}
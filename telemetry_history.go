@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Change events of a telemetry entry (telemetryevententity) - stored as children of the telemetry entity
+// ---------------------------------------------------------------------------------------------------------------//
+type TelemetryEventEntity struct {
+	Type        string `datastore:",noindex"`
+	FromVersion string `datastore:",noindex"`
+	ToVersion   string `datastore:",noindex"`
+	FromOS      string `datastore:",noindex"`
+	ToOS        string `datastore:",noindex"`
+	EventDate   time.Time
+}
+
+const (
+	telemetryEvent_Install = "install" // first call of a user key
+	telemetryEvent_Version = "version" // GoldenCheetah version changed
+	telemetryEvent_OS      = "os"      // operating system changed
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// API View Definition
+// ---------------------------------------------------------------------------------------------------------------//
+
+type TelemetryEventAPIv1 struct {
+	Type        string `json:"type"`
+	FromVersion string `json:"fromVersion"`
+	ToVersion   string `json:"toVersion"`
+	FromOS      string `json:"fromOperatingSystem"`
+	ToOS        string `json:"toOperatingSystem"`
+	EventDate   string `json:"eventDate"`
+}
+
+type TelemetryEventAPIv1List []TelemetryEventAPIv1
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Data Storage View
+// ---------------------------------------------------------------------------------------------------------------//
+
+const telemetryEventDBEntity = "telemetryevententity"
+
+func mapDBtoAPITelemetryEvent(db *TelemetryEventEntity, api *TelemetryEventAPIv1) {
+	api.Type = db.Type
+	api.FromVersion = db.FromVersion
+	api.ToVersion = db.ToVersion
+	api.FromOS = db.FromOS
+	api.ToOS = db.ToOS
+	api.EventDate = db.EventDate.Format(dateTimeLayout)
+}
+
+// supporting functions
+
+// telemetryEvents returns the events for the change from the previous state (nil for a new entry),
+// the events are dated with the time of the update
+func telemetryEvents(previous *TelemetryEntity, current *TelemetryEntity) []TelemetryEventEntity {
+	eventDate := current.LastChange
+	if previous == nil {
+		return []TelemetryEventEntity{{
+			Type:      telemetryEvent_Install,
+			ToVersion: current.GCVersion,
+			ToOS:      current.OS,
+			EventDate: eventDate,
+		}}
+	}
+	var events []TelemetryEventEntity
+	if previous.GCVersion != current.GCVersion {
+		events = append(events, TelemetryEventEntity{
+			Type:        telemetryEvent_Version,
+			FromVersion: previous.GCVersion,
+			ToVersion:   current.GCVersion,
+			FromOS:      current.OS,
+			ToOS:        current.OS,
+			EventDate:   eventDate,
+		})
+	}
+	if previous.OS != current.OS {
+		events = append(events, TelemetryEventEntity{
+			Type:        telemetryEvent_OS,
+			FromVersion: current.GCVersion,
+			ToVersion:   current.GCVersion,
+			FromOS:      previous.OS,
+			ToOS:        current.OS,
+			EventDate:   eventDate,
+		})
+	}
+	return events
+}
+
+// putTelemetryEvents stores the events as children of the telemetry entry
+func putTelemetryEvents(ctx context.Context, key *datastore.Key, events []TelemetryEventEntity) error {
+	if len(events) == 0 {
+		return nil
+	}
+	keys := make([]*datastore.Key, len(events))
+	for i := range events {
+		keys[i] = datastore.NewIncompleteKey(ctx, telemetryEventDBEntity, key)
+	}
+	_, err := datastore.PutMulti(ctx, keys, events)
+	return err
+}
+
+// deleteTelemetryKeys deletes the telemetry entries including their history
+func deleteTelemetryKeys(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		eventKeys, err := datastore.NewQuery(telemetryEventDBEntity).Ancestor(key).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := datastore.DeleteMulti(ctx, eventKeys); err != nil {
+			return err
+		}
+	}
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getTelemetryHistory returns the events of a user key - oldest first
+func getTelemetryHistory(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	userKey := request.PathParameter("key")
+
+	var eventOnDBList []TelemetryEventEntity
+	q := datastore.NewQuery(telemetryEventDBEntity).Ancestor(telemetryEntityKey(ctx, userKey))
+	if _, err := q.GetAll(ctx, &eventOnDBList); err != nil && !isErrFieldMismatch(err) {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	// sorted here to avoid a composite index
+	sort.Slice(eventOnDBList, func(i, j int) bool {
+		return eventOnDBList[i].EventDate.Before(eventOnDBList[j].EventDate)
+	})
+
+	// DB Entity needs to be mapped back
+	eventList := TelemetryEventAPIv1List{}
+	for _, eventDB := range eventOnDBList {
+		var eventAPI TelemetryEventAPIv1
+		mapDBtoAPITelemetryEvent(&eventDB, &eventAPI)
+		eventList = append(eventList, eventAPI)
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, eventList)
+}
+
+// getTelemetryTransitions counts the version upgrades ("from -> to") or OS switches since a date
+func getTelemetryTransitions(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	eventType := request.QueryParameter("type")
+	if eventType == "" {
+		eventType = telemetryEvent_Version
+	}
+	if eventType != telemetryEvent_Version && eventType != telemetryEvent_OS {
+		addInvalidRequestError(response, "Invalid type - must be 'version' or 'os'", nil)
+		return
+	}
+
+	from, ok := readTelemetryTime(request, response, "from", time.Now().UTC().Truncate(time.Hour).AddDate(0, 0, -30))
+	if !ok {
+		return
+	}
+
+	var countList TelemetryCountAPIv1List
+	cacheKey := fmt.Sprint("transitions-", eventType, "-", from.Unix())
+	err := getCachedTelemetryStats(ctx, cacheKey, &countList, func() error {
+		// the type is filtered here to avoid a composite index - the events are counted one
+		// after the other, not loaded at once
+		t := datastore.NewQuery(telemetryEventDBEntity).Filter("EventDate >=", from).Run(ctx)
+		counter := make(map[string]int)
+		for {
+			var eventDB TelemetryEventEntity
+			_, err := t.Next(&eventDB)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				return err
+			}
+			if eventDB.Type != eventType {
+				continue
+			}
+			if eventType == telemetryEvent_Version {
+				counter[fmt.Sprint(eventDB.FromVersion, " -> ", eventDB.ToVersion)]++
+			} else {
+				counter[fmt.Sprint(eventDB.FromOS, " -> ", eventDB.ToOS)]++
+			}
+		}
+		countList = countTelemetry(counter)
+		return nil
+	})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if countList == nil {
+		countList = TelemetryCountAPIv1List{}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, countList)
+}
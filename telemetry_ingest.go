@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Telemetry ingestion - PUT /telemetry only queues the update (pull queue "telemetry", see queue.yaml),
+// the updates are written in batches by a cron job (see cron.yaml)
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Payload of a queued telemetry update - the location is taken from the original request
+type telemetryUpdate struct {
+	TelemetryEntityPostAPIv1
+	Country     string `json:"country"`
+	Region      string `json:"region"`
+	City        string `json:"city"`
+	CityLatLong string `json:"cityLatLong"`
+}
+
+// Result of one ingestion run
+type TelemetryIngestAPIv1 struct {
+	Updates int `json:"updates"`
+	Users   int `json:"users"`
+	Failed  int `json:"failed"` // updates which are retried with the next run
+}
+
+const telemetryQueue = "telemetry"
+
+// Deleted user key - updates queued before the delete are dropped instead of recreating the entry
+type TelemetryTombstoneEntity struct {
+	DeleteDate time.Time
+}
+
+const telemetryTombstoneDBEntity = "telemetrytombstone"
+
+// tombstones are kept longer than updates wait in the queue (max. 7 days)
+const telemetryTombstoneExpiration = 8 * 24 * time.Hour
+
+// supporting functions
+
+// telemetryEntityKey returns the key of the entry of a user key - every entry is its own
+// entity group, so the write rate is not limited by a common ancestor
+func telemetryEntityKey(ctx context.Context, userKey string) *datastore.Key {
+	return datastore.NewKey(ctx, telemetryDBEntity, userKey, 0, nil)
+}
+
+// legacyTelemetryEntityKey returns the key of entries stored before the entries got their
+// own entity group - they are moved to the new key by migrateTelemetryKeys()
+func legacyTelemetryEntityKey(ctx context.Context, userKey string) *datastore.Key {
+	return datastore.NewKey(ctx, telemetryDBEntity, userKey, 0, telemetryEntityRootKey(ctx))
+}
+
+func telemetryTombstoneKey(ctx context.Context, userKey string) *datastore.Key {
+	return datastore.NewKey(ctx, telemetryTombstoneDBEntity, userKey, 0, nil)
+}
+
+// applyTelemetryUpdates writes all updates of a user key (oldest first) with one Put - updates
+// made before the user key was deleted are dropped
+func applyTelemetryUpdates(ctx context.Context, userKey string, updates []telemetryUpdate) error {
+	sort.SliceStable(updates, func(i, j int) bool {
+		return updates[i].LastChange < updates[j].LastChange
+	})
+
+	key := telemetryEntityKey(ctx, userKey)
+
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		tombstone := new(TelemetryTombstoneEntity)
+		err := datastore.Get(tc, telemetryTombstoneKey(tc, userKey), tombstone)
+		if err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+			return err
+		}
+		if err != datastore.ErrNoSuchEntity {
+			updates = telemetryUpdatesAfter(updates, tombstone.DeleteDate)
+			if len(updates) == 0 {
+				return nil
+			}
+		}
+
+		currentTelemetry := new(TelemetryEntity)
+		err = datastore.Get(tc, key, currentTelemetry)
+		if err != nil && err != datastore.ErrNoSuchEntity && !isErrFieldMismatch(err) {
+			return err
+		}
+		exists := err != datastore.ErrNoSuchEntity
+
+		var events []TelemetryEventEntity
+		for i := range updates {
+			var previousTelemetry *TelemetryEntity
+			if exists {
+				// entry found, increment counter
+				previousTelemetry = new(TelemetryEntity)
+				*previousTelemetry = *currentTelemetry
+				currentTelemetry.UseCount += updates[i].Increment
+			} else {
+				// entry not found, create a new one
+				currentTelemetry.Country = updates[i].Country
+				currentTelemetry.Region = updates[i].Region
+				currentTelemetry.City = updates[i].City
+				currentTelemetry.CityLatLong = updates[i].CityLatLong
+				currentTelemetry.UseCount = 1
+				currentTelemetry.CreateDate = time.Now()
+				exists = true
+			}
+			if telemetryCountryOnly() {
+				// also removes details stored before the option was set
+				coarsenTelemetry(currentTelemetry)
+			}
+			// general mapping
+			mapAPItoDBTelemetry(&updates[i].TelemetryEntityPostAPIv1, currentTelemetry)
+			// version/OS changes are kept as history
+			events = append(events, telemetryEvents(previousTelemetry, currentTelemetry)...)
+		}
+
+		if _, err := datastore.Put(tc, key, currentTelemetry); err != nil {
+			return err
+		}
+		return putTelemetryEvents(tc, key, events)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// telemetryUpdatesAfter returns the updates made after the date
+func telemetryUpdatesAfter(updates []telemetryUpdate, date time.Time) []telemetryUpdate {
+	var after []telemetryUpdate
+	for _, update := range updates {
+		if updateDate, err := time.Parse(dateTimeLayout, update.LastChange); err == nil && updateDate.After(date) {
+			after = append(after, update)
+		}
+	}
+	return after
+}
+
+// deleteExpiredTelemetryTombstones removes the tombstones no queued update can refer to anymore
+func deleteExpiredTelemetryTombstones(ctx context.Context) error {
+	keys, err := datastore.NewQuery(telemetryTombstoneDBEntity).
+		Filter("DeleteDate <", time.Now().Add(-telemetryTombstoneExpiration)).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+// moveLegacyTelemetry moves the entries from their legacy keys to their own entity groups - an
+// entry already updated at the new key (recreated by an update) is merged, the number of these
+// is returned
+func moveLegacyTelemetry(ctx context.Context, legacyKeys []*datastore.Key) (int, error) {
+	merged := 0
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		merged = 0
+		var keys []*datastore.Key
+		var telemetryOnDBList []TelemetryEntity
+		for _, legacyKey := range legacyKeys {
+			legacyTelemetry := new(TelemetryEntity)
+			if err := datastore.Get(tc, legacyKey, legacyTelemetry); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					// deleted meanwhile (opt-out)
+					continue
+				}
+				if !isErrFieldMismatch(err) {
+					return err
+				}
+			}
+			key := telemetryEntityKey(tc, legacyKey.StringID())
+			currentTelemetry := new(TelemetryEntity)
+			err := datastore.Get(tc, key, currentTelemetry)
+			switch {
+			case err == datastore.ErrNoSuchEntity:
+				*currentTelemetry = *legacyTelemetry
+			case err != nil && !isErrFieldMismatch(err):
+				return err
+			default:
+				currentTelemetry.CreateDate = legacyTelemetry.CreateDate
+				currentTelemetry.UseCount += legacyTelemetry.UseCount
+				merged++
+			}
+			keys = append(keys, key)
+			telemetryOnDBList = append(telemetryOnDBList, *currentTelemetry)
+		}
+		if len(keys) > 0 {
+			if _, err := datastore.PutMulti(tc, keys, telemetryOnDBList); err != nil {
+				return err
+			}
+		}
+		return datastore.DeleteMulti(tc, legacyKeys)
+	}, &datastore.TransactionOptions{XG: true})
+	return merged, err
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+func upsertTelemetry(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	update := new(telemetryUpdate)
+	if err := request.ReadEntity(&update.TelemetryEntityPostAPIv1); err != nil {
+		addInvalidRequestError(response, "Request body not readable", err)
+		return
+	}
+	// set Increment if not yet set (just in case)
+	if update.Increment == 0 {
+		update.Increment = 1
+	}
+	// the update is written later - so keep the time of the request
+	if update.LastChange == "" {
+		update.LastChange = time.Now().UTC().Format(dateTimeLayout)
+	}
+
+	// No checks if the necessary fields are filed or not - since GoldenCheetah is
+	// the only consumer of the APIs - any checks/response are to support this use-case
+
+	location := getGeoLocator().Locate(ctx, request.Request)
+	update.Country = location.Country
+	update.Region = location.Region
+	update.City = location.City
+	update.CityLatLong = location.CityLatLong
+
+	payload, err := json.Marshal(update)
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	task := &taskqueue.Task{Method: "PULL", Payload: payload}
+	if _, err := taskqueue.Add(ctx, task, telemetryQueue); err != nil {
+		// the queue is not available - write the update directly
+		log.Warningf(ctx, "Queueing telemetry failed, writing directly: %v", err)
+		if err := applyTelemetryUpdates(ctx, update.UserKey, []telemetryUpdate{*update}); err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+	}
+
+	// Response is Empty for 202
+	response.WriteHeaderAndEntity(http.StatusAccepted, "")
+}
+
+// ingestTelemetry writes the queued updates - it's called by cron, a run stops when the queue
+// is empty or after some time
+func ingestTelemetry(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	const maxDurationPerCall = 45 * time.Second
+	const maxTasksPerLease = 1000
+	const leaseSeconds = 120
+	const parallelWrites = 10
+
+	var result TelemetryIngestAPIv1
+	start := time.Now()
+	for time.Since(start) < maxDurationPerCall {
+		tasks, err := taskqueue.Lease(ctx, maxTasksPerLease, telemetryQueue, leaseSeconds)
+		if err != nil {
+			commonResponseErrorProcessing(response, err)
+			return
+		}
+		if len(tasks) == 0 {
+			break
+		}
+
+		// group the updates by user key
+		updates := make(map[string][]telemetryUpdate)
+		userTasks := make(map[string][]*taskqueue.Task)
+		var done []*taskqueue.Task
+		for _, task := range tasks {
+			var update telemetryUpdate
+			if err := json.Unmarshal(task.Payload, &update); err != nil {
+				// will never succeed - drop it
+				log.Errorf(ctx, "Invalid telemetry update dropped: %v", err)
+				done = append(done, task)
+				continue
+			}
+			updates[update.UserKey] = append(updates[update.UserKey], update)
+			userTasks[update.UserKey] = append(userTasks[update.UserKey], task)
+		}
+
+		// every user key is an own entity group - so they can be written in parallel
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, parallelWrites)
+		for userKey := range updates {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(userKey string) {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+				err := applyTelemetryUpdates(ctx, userKey, updates[userKey])
+				mutex.Lock()
+				defer mutex.Unlock()
+				if err != nil {
+					// the lease expires and the updates are processed again
+					log.Warningf(ctx, "Writing telemetry of %s failed: %v", userKey, err)
+					result.Failed += len(userTasks[userKey])
+					return
+				}
+				result.Users++
+				result.Updates += len(userTasks[userKey])
+				done = append(done, userTasks[userKey]...)
+			}(userKey)
+		}
+		wg.Wait()
+
+		if len(done) > 0 {
+			if err := taskqueue.DeleteMulti(ctx, done, telemetryQueue); err != nil {
+				// deleted with the next run - the updates are written twice then
+				log.Errorf(ctx, "Deleting processed telemetry tasks failed: %v", err)
+			}
+		}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, result)
+}
@@ -0,0 +1,399 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Telemetry aggregation - computed from the telemetry entities and cached in memcache
+// ---------------------------------------------------------------------------------------------------------------//
+
+// Number of installs per value of the grouping attribute
+type TelemetryCountAPIv1 struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type TelemetryCountAPIv1List []TelemetryCountAPIv1
+
+// Installs active within the last day/week/month (based on the last use)
+type TelemetryActiveAPIv1 struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Total   int `json:"total"`
+}
+
+// Installs used in or after a period grouped by the version used at the end of the period
+type TelemetryAdoptionAPIv1 struct {
+	PeriodStart string                  `json:"periodStart"`
+	Versions    TelemetryCountAPIv1List `json:"versions"`
+}
+
+type TelemetryAdoptionAPIv1List []TelemetryAdoptionAPIv1
+
+// values of the "groupBy" query parameter
+const (
+	telemetryGroupBy_Version = "version"
+	telemetryGroupBy_OS      = "os"
+	telemetryGroupBy_Country = "country"
+	telemetryGroupBy_Release = "release" // semantic version of the GC version (see entity_version.go)
+)
+
+// values of the "interval" query parameter
+const (
+	telemetryInterval_Day  = "day"
+	telemetryInterval_Week = "week"
+)
+
+// ---------------------------------------------------------------------------------------------------------------//
+// Memcache constants
+// ---------------------------------------------------------------------------------------------------------------//
+
+const telemetryStatsMemcacheKey = "telemetrystats"
+
+// aggregates are recomputed at most once per hour
+const telemetryStatsExpiration = time.Hour
+
+// supporting functions
+
+// readTelemetryTime reads an RFC3339 query parameter, false is returned if the request is already answered
+func readTelemetryTime(request *restful.Request, response *restful.Response, name string, defaultTime time.Time) (time.Time, bool) {
+	dateString := request.QueryParameter(name)
+	if dateString == "" {
+		return defaultTime, true
+	}
+	date, err := time.Parse(time.RFC3339, dateString)
+	if err != nil {
+		addInvalidRequestError(response, fmt.Sprintf("Invalid %s - correct format is RFC3339", name), err)
+		return date, false
+	}
+	return date, true
+}
+
+// Data of an install needed for the aggregates - the events are the history since the start
+// of the evaluated time frame, oldest first
+type telemetryInstall struct {
+	CreateDate time.Time
+	LastChange time.Time
+	GCVersion  string
+	OS         string
+	Country    string
+	events     []TelemetryEventEntity
+}
+
+// at returns the version and OS the install used at the date - false if it was not yet installed
+func (install *telemetryInstall) at(date time.Time) (string, string, bool) {
+	if !install.CreateDate.IsZero() && !install.CreateDate.Before(date) {
+		return "", "", false
+	}
+	// the first change after the date knows the previous state
+	for _, event := range install.events {
+		if event.EventDate.Before(date) {
+			continue
+		}
+		if event.Type == telemetryEvent_Install {
+			return "", "", false
+		}
+		return event.FromVersion, event.FromOS, true
+	}
+	return install.GCVersion, install.OS, true
+}
+
+// getTelemetryInstallsSince returns the installs used since the date with the history since
+// historySince - both queries are processed one entry after the other
+func getTelemetryInstallsSince(ctx context.Context, since time.Time, historySince time.Time) (map[string]*telemetryInstall, error) {
+	installs := make(map[string]*telemetryInstall)
+
+	t := datastore.NewQuery(telemetryDBEntity).Filter("LastChange >=", since).Run(ctx)
+	for {
+		var telemetryDB TelemetryEntity
+		key, err := t.Next(&telemetryDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		installs[key.String()] = &telemetryInstall{
+			CreateDate: telemetryDB.CreateDate,
+			LastChange: telemetryDB.LastChange,
+			GCVersion:  telemetryDB.GCVersion,
+			OS:         telemetryDB.OS,
+			Country:    telemetryDB.Country,
+		}
+	}
+
+	t = datastore.NewQuery(telemetryEventDBEntity).Filter("EventDate >=", historySince).Order("EventDate").Run(ctx)
+	for {
+		var eventDB TelemetryEventEntity
+		key, err := t.Next(&eventDB)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		if install, ok := installs[key.Parent().String()]; ok {
+			install.events = append(install.events, eventDB)
+		}
+	}
+
+	return installs, nil
+}
+
+// getCachedTelemetryStats returns the cached aggregate or computes (and caches) it - gob
+// does not keep empty lists, so the handlers have to take care of nil lists
+func getCachedTelemetryStats(ctx context.Context, cacheKey string, result interface{}, compute func() error) error {
+	key := fmt.Sprint(telemetryStatsMemcacheKey, "-", cacheKey)
+	if _, err := memcache.Gob.Get(ctx, key, result); err == nil {
+		return nil
+	}
+	if err := compute(); err != nil {
+		return err
+	}
+	// add to memcache / overwrite existing / ignore errors
+	item := &memcache.Item{
+		Key:        key,
+		Object:     result,
+		Expiration: telemetryStatsExpiration,
+	}
+	memcache.Gob.Set(ctx, item)
+	return nil
+}
+
+func countTelemetry(counter map[string]int) TelemetryCountAPIv1List {
+	countList := TelemetryCountAPIv1List{}
+	for key, count := range counter {
+		countList = append(countList, TelemetryCountAPIv1{Key: key, Count: count})
+	}
+	sort.Slice(countList, func(i, j int) bool {
+		if countList[i].Count != countList[j].Count {
+			return countList[i].Count > countList[j].Count
+		}
+		return countList[i].Key < countList[j].Key
+	})
+	return countList
+}
+
+// telemetryPeriodStart returns the start (UTC) of the day or week (starting Monday) of the date
+func telemetryPeriodStart(date time.Time, interval string) time.Time {
+	date = date.UTC()
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	if interval == telemetryInterval_Week {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+// telemetryPeriodEnd returns the start of the next day or week
+func telemetryPeriodEnd(start time.Time, interval string) time.Time {
+	if interval == telemetryInterval_Week {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// ---------------------------------------------------------------------------------------------------------------//
+// request/response handler
+// ---------------------------------------------------------------------------------------------------------------//
+
+// getTelemetryInstalls counts the installs used since activeAfter and installed before activeBefore
+// by the version/os (from the history) used at activeBefore or by country
+func getTelemetryInstalls(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	groupBy := request.QueryParameter("groupBy")
+	if groupBy == "" {
+		groupBy = telemetryGroupBy_Version
+	}
+	if groupBy != telemetryGroupBy_Version && groupBy != telemetryGroupBy_OS && groupBy != telemetryGroupBy_Country &&
+		groupBy != telemetryGroupBy_Release {
+		addInvalidRequestError(response, "Invalid groupBy - must be 'version', 'release', 'os' or 'country'", nil)
+		return
+	}
+
+	// full hours only - so that the cache is used
+	now := time.Now().UTC().Truncate(time.Hour)
+	activeAfter, ok := readTelemetryTime(request, response, "activeAfter", now.AddDate(0, 0, -30))
+	if !ok {
+		return
+	}
+	activeBefore, ok := readTelemetryTime(request, response, "activeBefore", time.Time{})
+	if !ok {
+		return
+	}
+
+	var countList TelemetryCountAPIv1List
+	cacheKey := fmt.Sprint("installs-", groupBy, "-", activeAfter.Unix(), "-", activeBefore.Unix())
+	err := getCachedTelemetryStats(ctx, cacheKey, &countList, func() error {
+		// the installs are counted with the version/OS they used at the end of the window
+		end := activeBefore
+		if end.IsZero() {
+			end = time.Now()
+		}
+		installs, err := getTelemetryInstallsSince(ctx, activeAfter, end)
+		if err != nil {
+			return err
+		}
+		var releases versionReleases
+		if groupBy == telemetryGroupBy_Release {
+			if releases, err = loadVersionReleases(ctx); err != nil {
+				return err
+			}
+		}
+		counter := make(map[string]int)
+		for _, install := range installs {
+			version, operatingSystem, installed := install.at(end)
+			if !installed {
+				continue
+			}
+			switch groupBy {
+			case telemetryGroupBy_Version:
+				counter[version]++
+			case telemetryGroupBy_Release:
+				counter[releases.release(version)]++
+			case telemetryGroupBy_OS:
+				counter[operatingSystem]++
+			case telemetryGroupBy_Country:
+				counter[install.Country]++
+			}
+		}
+		countList = countTelemetry(counter)
+		return nil
+	})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if countList == nil {
+		countList = TelemetryCountAPIv1List{}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, countList)
+}
+
+// getTelemetryActive returns the number of installs used within the last day, week and month
+func getTelemetryActive(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	var active TelemetryActiveAPIv1
+	err := getCachedTelemetryStats(ctx, "active", &active, func() error {
+		now := time.Now()
+		q := datastore.NewQuery(telemetryDBEntity).KeysOnly()
+		var err error
+		if active.Total, err = q.Count(ctx); err != nil {
+			return err
+		}
+		if active.Monthly, err = q.Filter("LastChange >=", now.AddDate(0, 0, -30)).Count(ctx); err != nil {
+			return err
+		}
+		if active.Weekly, err = q.Filter("LastChange >=", now.AddDate(0, 0, -7)).Count(ctx); err != nil {
+			return err
+		}
+		active.Daily, err = q.Filter("LastChange >=", now.AddDate(0, 0, -1)).Count(ctx)
+		return err
+	})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, active)
+}
+
+// getTelemetryAdoption returns per day/week the installs used in or after the period by the version
+// used at the end of the period (from the history)
+func getTelemetryAdoption(request *restful.Request, response *restful.Response) {
+	ctx := appengine.NewContext(request.Request)
+
+	interval := request.QueryParameter("interval")
+	if interval == "" {
+		interval = telemetryInterval_Week
+	}
+	if interval != telemetryInterval_Day && interval != telemetryInterval_Week {
+		addInvalidRequestError(response, "Invalid interval - must be 'day' or 'week'", nil)
+		return
+	}
+
+	from, ok := readTelemetryTime(request, response, "from", time.Now().AddDate(0, 0, -7*12))
+	if !ok {
+		return
+	}
+	from = telemetryPeriodStart(from, interval)
+
+	var adoptionList TelemetryAdoptionAPIv1List
+	cacheKey := fmt.Sprint("adoption-", interval, "-", from.Unix())
+	err := getCachedTelemetryStats(ctx, cacheKey, &adoptionList, func() error {
+		installs, err := getTelemetryInstallsSince(ctx, from, from)
+		if err != nil {
+			return err
+		}
+		// every install used in or after a period is counted with the version it used at the end of the period
+		now := time.Now()
+		periods := make(map[time.Time]map[string]int)
+		for start := from; start.Before(now); start = telemetryPeriodEnd(start, interval) {
+			end := telemetryPeriodEnd(start, interval)
+			if end.After(now) {
+				end = now
+			}
+			counter := make(map[string]int)
+			for _, install := range installs {
+				if install.LastChange.Before(start) {
+					continue
+				}
+				if version, _, installed := install.at(end); installed {
+					counter[version]++
+				}
+			}
+			periods[start] = counter
+		}
+		adoptionList = TelemetryAdoptionAPIv1List{}
+		for start, counter := range periods {
+			adoptionList = append(adoptionList, TelemetryAdoptionAPIv1{
+				PeriodStart: start.Format(dateTimeLayout),
+				Versions:    countTelemetry(counter),
+			})
+		}
+		sort.Slice(adoptionList, func(i, j int) bool {
+			return adoptionList[i].PeriodStart < adoptionList[j].PeriodStart
+		})
+		return nil
+	})
+	if err != nil {
+		commonResponseErrorProcessing(response, err)
+		return
+	}
+	if adoptionList == nil {
+		adoptionList = TelemetryAdoptionAPIv1List{}
+	}
+
+	response.WriteHeaderAndEntity(http.StatusOK, adoptionList)
+}
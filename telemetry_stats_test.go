@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2020 Joern Rischmueller (joern.rm@gmail.com)
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelemetryInstallAt(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	install := &telemetryInstall{
+		CreateDate: day(2),
+		GCVersion:  "3.6",
+		OS:         "Linux",
+		events: []TelemetryEventEntity{
+			{Type: telemetryEvent_Install, ToVersion: "3.4", ToOS: "Windows", EventDate: day(2)},
+			{Type: telemetryEvent_Version, FromVersion: "3.4", ToVersion: "3.5", FromOS: "Windows", ToOS: "Windows", EventDate: day(10)},
+			{Type: telemetryEvent_OS, FromVersion: "3.5", ToVersion: "3.5", FromOS: "Windows", ToOS: "Linux", EventDate: day(15)},
+			{Type: telemetryEvent_Version, FromVersion: "3.5", ToVersion: "3.6", FromOS: "Linux", ToOS: "Linux", EventDate: day(20)},
+		},
+	}
+	// without history before the evaluated time frame
+	legacy := &telemetryInstall{GCVersion: "3.6", OS: "Linux"}
+
+	tests := []struct {
+		name      string
+		install   *telemetryInstall
+		date      time.Time
+		version   string
+		os        string
+		installed bool
+	}{
+		{"before install", install, day(1), "", "", false},
+		{"at install", install, day(2), "", "", false},
+		{"after install", install, day(5), "3.4", "Windows", true},
+		{"after upgrade", install, day(12), "3.5", "Windows", true},
+		{"after os switch", install, day(16), "3.5", "Linux", true},
+		{"current", install, day(25), "3.6", "Linux", true},
+		{"no history", legacy, day(5), "3.6", "Linux", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, os, installed := tt.install.at(tt.date)
+			if version != tt.version || os != tt.os || installed != tt.installed {
+				t.Errorf("at() = %q, %q, %v, want %q, %q, %v", version, os, installed, tt.version, tt.os, tt.installed)
+			}
+		})
+	}
+}